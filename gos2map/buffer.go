@@ -0,0 +1,169 @@
+package gos2map
+
+import (
+	"math"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/r3"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// circleVertices is the number of vertices used to approximate the
+// circles around buffered points and vertices.
+const circleVertices = 32
+
+// maxBufferMeters bounds the buffer distance. circle and capsule assume a
+// radius well under a quarter of a great circle, about 10,000 km, past
+// which their loops flip and cover the complement.
+const maxBufferMeters = 5000e3
+
+// circle returns a counterclockwise loop approximating the circle of the
+// given angular radius around center.
+func circle(center s2.Point, radius float64) []s2.Point {
+	axis := r3.Vector{Z: 1}
+	if math.Abs(center.Z) > 0.9 {
+		axis = r3.Vector{X: 1}
+	}
+	u := center.Cross(axis).Normalize()
+	v := center.Cross(u)
+	points := make([]s2.Point, circleVertices)
+	for i := range points {
+		theta := 2 * math.Pi * float64(i) / circleVertices
+		dir := u.Mul(math.Cos(theta)).Add(v.Mul(math.Sin(theta)))
+		p := center.Mul(math.Cos(radius)).Add(dir.Mul(math.Sin(radius)))
+		points[i] = s2.Point{Vector: p.Normalize()}
+	}
+	return points
+}
+
+// capsule returns the region within radius of edge AB, built from a
+// quadrilateral along the edge and circles around both ends.
+func capsule(a, b s2.Point, radius float64) []*s2.Polygon {
+	polygons := []*s2.Polygon{
+		polygonFromPath(circle(a, radius)),
+		polygonFromPath(circle(b, radius)),
+	}
+	if a == b {
+		return polygons[:1]
+	}
+	// n points to the left of AB.
+	n := a.Cross(b.Vector).Normalize().Mul(math.Sin(radius))
+	offset := func(p s2.Point, sign float64) s2.Point {
+		return s2.Point{Vector: p.Mul(math.Cos(radius)).Add(n.Mul(sign)).Normalize()}
+	}
+	quad := []s2.Point{offset(a, -1), offset(b, -1), offset(b, 1), offset(a, 1)}
+	return append(polygons, polygonFromPath(quad))
+}
+
+// pathBuffer returns the region within radius of the path through points.
+func pathBuffer(points []s2.Point, closed bool, radius float64) []*s2.Polygon {
+	var polygons []*s2.Polygon
+	n := len(points)
+	if n == 1 {
+		return []*s2.Polygon{polygonFromPath(circle(points[0], radius))}
+	}
+	edges := n - 1
+	if closed {
+		edges = n
+	}
+	for i := 0; i < edges; i++ {
+		polygons = append(polygons, capsule(points[i], points[(i+1)%n], radius)...)
+	}
+	return polygons
+}
+
+func loopPoints(loop *s2.Loop) []s2.Point {
+	points := make([]s2.Point, loop.NumVertices())
+	for i := range points {
+		points[i] = *loop.Vertex(i)
+	}
+	return points
+}
+
+// bufferGeometry grows geom by radius, or shrinks it if radius is
+// negative. Points and lines have no interior to shrink, so a negative
+// radius leaves nothing of them.
+func bufferGeometry(geom geojson.GeoJSON, radius float64) (*s2.Polygon, error) {
+	var parts []*s2.Polygon
+	switch geom := geom.(type) {
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			poly, err := bufferGeometry(g, radius)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, poly)
+		}
+		return unionAll(parts), nil
+	case geojson.Point, geojson.MultiPoint:
+		if radius > 0 {
+			for _, p := range geometryToS2Points(geom) {
+				parts = append(parts, polygonFromPath(circle(p, radius)))
+			}
+		}
+		return unionAll(parts), nil
+	case geojson.LineString, geojson.MultiLineString:
+		if radius > 0 {
+			for _, line := range lineStringPoints(geom) {
+				parts = append(parts, pathBuffer(line, false, radius)...)
+			}
+		}
+		return unionAll(parts), nil
+	}
+	poly, err := geometryToS2Polygon(geom)
+	if err != nil {
+		return nil, err
+	}
+	if poly == nil {
+		return nil, ErrUnsupportedGeometry
+	}
+	if radius == 0 {
+		return poly, nil
+	}
+	for i := 0; i < poly.NumLoops(); i++ {
+		parts = append(parts, pathBuffer(loopPoints(poly.Loop(i)), true, math.Abs(radius))...)
+	}
+	boundary := unionAll(parts)
+	var c s2.Polygon
+	if radius > 0 {
+		c.InitToUnion(poly, boundary)
+	} else {
+		c.InitToDifference(poly, boundary)
+	}
+	return &c, nil
+}
+
+// Buffer returns every input feature grown by meters, or shrunk if
+// meters is negative. Features that shrink away entirely are left out.
+// meters may be at most maxBufferMeters either way.
+func Buffer(js geojson.GeoJSON, meters float64) (*geojson.FeatureCollection, error) {
+	if math.IsNaN(meters) || math.Abs(meters) > maxBufferMeters {
+		return nil, ErrInvalidDistance
+	}
+	features := flattenGeoJSON(js)
+	if len(features) == 0 {
+		return nil, ErrNoPolygons
+	}
+	radius := metersToAngle(meters)
+	output := []geojson.Feature{}
+	for _, f := range features {
+		poly, err := bufferGeometry(f.geometry, radius)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		if poly.NumLoops() == 0 {
+			continue
+		}
+		output = append(output, geojson.Feature{
+			Typ:        "Feature",
+			Id:         f.id,
+			Properties: f.properties,
+			Geometry:   s2PolygonToGeometry(*poly),
+		})
+	}
+	fc := &geojson.FeatureCollection{
+		Typ:      "FeatureCollection",
+		Features: output,
+	}
+	return fc, nil
+}
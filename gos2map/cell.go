@@ -0,0 +1,266 @@
+package gos2map
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// CellInfo describes a cell along with its place in the hierarchy.
+// Parents run from the face cell down to the immediate parent.
+type CellInfo struct {
+	Cell      CellIDJSON   `json:"cell"`
+	Area      float64      `json:"area_m2"`
+	Parents   []CellIDJSON `json:"parents"`
+	Children  []CellIDJSON `json:"children"`
+	Neighbors []CellIDJSON `json:"neighbors"`
+}
+
+func cellChildren(id s2.CellID) []s2.CellID {
+	var children []s2.CellID
+	if id.IsLeaf() {
+		return children
+	}
+	for c := id.ChildBegin(); c != id.ChildEnd(); c = c.Next() {
+		children = append(children, c)
+	}
+	return children
+}
+
+func NewCellInfo(id s2.CellID) *CellInfo {
+	var parents []s2.CellID
+	for level := 0; level < id.Level(); level++ {
+		parents = append(parents, id.Parent(level))
+	}
+	neighbors := id.EdgeNeighbors()
+	return &CellInfo{
+		Cell:      cellIdsToCovering([]s2.CellID{id})[0],
+		Area:      s2.CellFromCellID(id).ExactArea() * earthRadiusMeters * earthRadiusMeters,
+		Parents:   cellIdsToCovering(parents),
+		Children:  cellIdsToCovering(cellChildren(id)),
+		Neighbors: cellIdsToCovering(neighbors[:]),
+	}
+}
+
+// cellIDFromRequest looks a cell up by token, unsigned id, signed id or
+// lat/lng and level, in that order of preference. The level of a lat/lng
+// lookup is read from levelParam and defaults to leaf cells.
+func cellIDFromRequest(r *http.Request, levelParam string) (s2.CellID, error) {
+	var id s2.CellID
+	switch {
+	case r.FormValue("token") != "":
+		id = s2.CellIDFromToken(r.FormValue("token"))
+	case r.FormValue("id") != "":
+		v, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return 0, ErrInvalidCell
+		}
+		id = s2.CellID(v)
+	case r.FormValue("id_signed") != "":
+		v, err := strconv.ParseInt(r.FormValue("id_signed"), 10, 64)
+		if err != nil {
+			return 0, ErrInvalidCell
+		}
+		id = s2.CellID(uint64(v))
+	case r.FormValue("lat") != "" && r.FormValue("lng") != "":
+		lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
+		if err != nil {
+			return 0, ErrInvalidRequest
+		}
+		lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
+		if err != nil {
+			return 0, ErrInvalidRequest
+		}
+		level := s2.MaxCellLevel
+		if r.FormValue(levelParam) != "" {
+			level, err = strconv.Atoi(r.FormValue(levelParam))
+			if err != nil || level < 0 || level > s2.MaxCellLevel {
+				return 0, ErrInvalidLevel
+			}
+		}
+		id = s2.CellIDFromLatLng(s2.LatLngFromDegrees(lat, lng)).Parent(level)
+	default:
+		return 0, ErrInvalidRequest
+	}
+	if !id.IsValid() {
+		return 0, ErrInvalidCell
+	}
+	return id, nil
+}
+
+func isDecimal(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseCellID reads a cell from a token, a decimal unsigned or signed id,
+// or a 0x-prefixed hex id. All-digit strings of up to 16 characters are
+// read as tokens first, and only as decimal ids if that gives no valid
+// cell.
+func parseCellID(s string) (s2.CellID, error) {
+	var id s2.CellID
+	switch {
+	case strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X"):
+		v, err := strconv.ParseUint(s[2:], 16, 64)
+		if err != nil {
+			return 0, ErrInvalidCell
+		}
+		id = s2.CellID(v)
+	case strings.HasPrefix(s, "-"):
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, ErrInvalidCell
+		}
+		id = s2.CellID(uint64(v))
+	case isDecimal(s) && len(s) > 16:
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, ErrInvalidCell
+		}
+		id = s2.CellID(v)
+	default:
+		id = s2.CellIDFromToken(s)
+		if !id.IsValid() && isDecimal(s) {
+			v, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return 0, ErrInvalidCell
+			}
+			id = s2.CellID(v)
+		}
+	}
+	if !id.IsValid() {
+		return 0, ErrInvalidCell
+	}
+	return id, nil
+}
+
+// parseCellList parses a list of cells separated by commas or
+// whitespace. An invalid entry is reported as a FeatureError carrying
+// its position in the list.
+func parseCellList(text string) ([]s2.CellID, error) {
+	fields := strings.FieldsFunc(text, func(c rune) bool {
+		return c == ',' || unicode.IsSpace(c)
+	})
+	if len(fields) == 0 {
+		return nil, ErrInvalidRequest
+	}
+	ids := make([]s2.CellID, len(fields))
+	for i, f := range fields {
+		id, err := parseCellID(f)
+		if err != nil {
+			return nil, &FeatureError{Index: i, Err: err}
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+const (
+	NeighborsEdge   = "edge"
+	NeighborsVertex = "vertex"
+	NeighborsAll    = "all"
+)
+
+func parseNeighborType(s string) (string, error) {
+	switch s {
+	case "":
+		return NeighborsEdge, nil
+	case NeighborsEdge, NeighborsVertex, NeighborsAll:
+		return s, nil
+	}
+	return "", ErrInvalidNeighborType
+}
+
+// maxKRing caps the number of rings a k-ring expansion may produce.
+const maxKRing = 50
+
+// cellNeighbors returns the neighbors of id. Vertex neighbors are cells at
+// a level coarser than id, all neighbors are cells at level or finer
+// touching id; edge neighbors are always at the level of id.
+func cellNeighbors(id s2.CellID, kind string, level int) ([]s2.CellID, error) {
+	var ids []s2.CellID
+	switch kind {
+	case NeighborsEdge:
+		neighbors := id.EdgeNeighbors()
+		ids = neighbors[:]
+	case NeighborsVertex:
+		if level < 0 || level >= id.Level() {
+			return nil, ErrInvalidLevel
+		}
+		ids = id.VertexNeighbors(level)
+	case NeighborsAll:
+		if level < id.Level() || level > s2.MaxCellLevel {
+			return nil, ErrInvalidLevel
+		}
+		ids = id.AllNeighbors(level)
+	default:
+		return nil, ErrInvalidNeighborType
+	}
+	sortCovering(ids)
+	return ids, nil
+}
+
+// kRing expands outwards from id k times, returning the cells first
+// reached at each step. Each step takes the edge or all neighbors of the
+// previous ring at the level of id.
+func kRing(id s2.CellID, kind string, k int) ([][]s2.CellID, error) {
+	if kind == NeighborsVertex {
+		return nil, ErrInvalidNeighborType
+	}
+	if k < 0 || k > maxKRing {
+		return nil, ErrInvalidRequest
+	}
+	seen := map[s2.CellID]struct{}{id: {}}
+	frontier := []s2.CellID{id}
+	rings := [][]s2.CellID{}
+	for i := 0; i < k; i++ {
+		var ring []s2.CellID
+		for _, c := range frontier {
+			neighbors, err := cellNeighbors(c, kind, id.Level())
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range neighbors {
+				if _, ok := seen[n]; !ok {
+					seen[n] = struct{}{}
+					ring = append(ring, n)
+				}
+			}
+		}
+		if len(seen) > maxUniformCells {
+			return nil, ErrTooManyCells
+		}
+		sortCovering(ring)
+		rings = append(rings, ring)
+		frontier = ring
+	}
+	return rings, nil
+}
+
+// cellChildrenAtLevel returns the descendants of id at level.
+func cellChildrenAtLevel(id s2.CellID, level int) ([]s2.CellID, error) {
+	if level <= id.Level() || level > s2.MaxCellLevel {
+		return nil, ErrInvalidLevel
+	}
+	return uniformCovering([]s2.CellID{id}, level)
+}
+
+// intParam reads an optional integer form value, returning def when it
+// is missing.
+func intParam(r *http.Request, name string, def int) (int, error) {
+	if r.FormValue(name) == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		return 0, ErrInvalidRequest
+	}
+	return v, nil
+}
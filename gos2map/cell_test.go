@@ -0,0 +1,67 @@
+package gos2map
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davidreynolds/gos2/s2"
+)
+
+func TestParseCellID(t *testing.T) {
+	// 89c25 is a level 8 cell over New York.
+	nyc := s2.CellID(0x89c2500000000000)
+	tests := []struct {
+		in      string
+		want    s2.CellID
+		invalid bool
+	}{
+		{in: "89c25", want: nyc},
+		{in: "9926584489608216576", want: nyc},
+		{in: "-8520159584101335040", want: nyc},
+		{in: "0x89c2500000000000", want: nyc},
+		{in: "0X89C2500000000000", want: nyc},
+		// Short all-digit strings are tokens when they name a valid
+		// cell: "1" is face 0.
+		{in: "1", want: s2.CellID(0x1000000000000000)},
+		// "12" is not a valid token, so it is read as a decimal id.
+		{in: "12", want: s2.CellID(12)},
+		{in: "0", invalid: true},
+		{in: "X", invalid: true},
+		{in: "zz", invalid: true},
+		{in: "0xzz", invalid: true},
+		{in: "-abc", invalid: true},
+		{in: "99999999999999999999", invalid: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCellID(tt.in)
+		if tt.invalid {
+			if err != ErrInvalidCell {
+				t.Errorf("parseCellID(%q) = %v, %v; want ErrInvalidCell", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseCellID(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseCellList(t *testing.T) {
+	nyc := s2.CellID(0x89c2500000000000)
+	ids, err := parseCellList("89c25, 9926584489608216576\n0x89c2500000000000\t-8520159584101335040")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []s2.CellID{nyc, nyc, nyc, nyc}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("parseCellList = %v, want %v", ids, want)
+	}
+
+	_, err = parseCellList("89c25,\nzz")
+	if ferr, ok := err.(*FeatureError); !ok || ferr.Index != 1 || ferr.Err != ErrInvalidCell {
+		t.Errorf("parseCellList error = %v, want entry 1 invalid", err)
+	}
+
+	if _, err := parseCellList(" ,\n"); err != ErrInvalidRequest {
+		t.Errorf("parseCellList of an empty list = %v, want ErrInvalidRequest", err)
+	}
+}
@@ -0,0 +1,717 @@
+package gos2map
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// coverResponse wraps a covering when extra information was requested
+// alongside the cells. Repairs is set, possibly to an empty list, exactly
+// when repair was requested.
+type coverResponse struct {
+	Cells      interface{}     `json:"cells"`
+	Normalized bool            `json:"normalized"`
+	Repairs    *[]Repair       `json:"repairs,omitempty"`
+	Stats      []CoveringStats `json:"stats,omitempty"`
+}
+
+// pointCoveringLevel returns the finest level allowed by the coverer
+// options, which is the level used to cover points.
+func pointCoveringLevel(minLevel, maxLevel, levelMod int) int {
+	if maxLevel > s2.MaxCellLevel {
+		maxLevel = s2.MaxCellLevel
+	}
+	if maxLevel < minLevel {
+		return minLevel
+	}
+	if levelMod > 1 {
+		maxLevel -= (maxLevel - minLevel) % levelMod
+	}
+	return maxLevel
+}
+
+// coverGeometry returns the covering of geom, or its interior covering
+// if interior is set. Points and lines have no interior, so they add
+// nothing to an interior covering.
+func coverGeometry(coverer *s2.RegionCoverer, geom geojson.GeoJSON, pointLevel int, interior bool) ([]s2.CellID, error) {
+	var cover []s2.CellID
+	switch geom := geom.(type) {
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			c, err := coverGeometry(coverer, g, pointLevel, interior)
+			if err != nil {
+				return nil, err
+			}
+			cover = append(cover, c...)
+		}
+	case geojson.Point, geojson.MultiPoint:
+		if interior {
+			break
+		}
+		for _, p := range geometryToS2Points(geom) {
+			cover = append(cover, s2.CellIDFromPoint(p).Parent(pointLevel))
+		}
+	case geojson.LineString, geojson.MultiLineString:
+		if interior {
+			break
+		}
+		for _, line := range geometryToS2Polylines(geom) {
+			cover = append(cover, coverer.Covering(line)...)
+		}
+	default:
+		poly, err := geometryToS2Polygon(geom)
+		if err != nil {
+			return nil, err
+		}
+		if poly == nil {
+			return nil, ErrUnsupportedGeometry
+		}
+		if interior {
+			cover = coverer.InteriorCovering(poly)
+		} else {
+			cover = coverer.Covering(poly)
+		}
+	}
+	return cover, nil
+}
+
+// coverFeatures returns the cells of the coverings of features, without
+// duplicates and in no particular order.
+func coverFeatures(coverer *s2.RegionCoverer, features []feature, pointLevel int, interior bool) ([]s2.CellID, error) {
+	coverMap := make(map[s2.CellID]struct{})
+	for _, f := range features {
+		cover, err := coverGeometry(coverer, f.geometry, pointLevel, interior)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		for _, c := range cover {
+			coverMap[c] = struct{}{}
+		}
+	}
+	covering := make([]s2.CellID, 0, len(coverMap))
+	for k, _ := range coverMap {
+		covering = append(covering, k)
+	}
+	return covering, nil
+}
+
+const (
+	CoveringExterior = "exterior"
+	CoveringInterior = "interior"
+	CoveringBoth     = "both"
+)
+
+func parseCoveringType(s string) (string, error) {
+	switch s {
+	case "":
+		return CoveringExterior, nil
+	case CoveringExterior, CoveringInterior, CoveringBoth:
+		return s, nil
+	}
+	return "", ErrInvalidCoveringType
+}
+
+const (
+	FormatFull    = "full"
+	FormatTokens  = "tokens"
+	FormatIds     = "ids"
+	FormatRanges  = "ranges"
+	FormatCSV     = "csv"
+	FormatGeoJSON = "geojson"
+)
+
+func parseCoverFormat(s string) (string, error) {
+	switch s {
+	case "":
+		return FormatFull, nil
+	case FormatFull, FormatTokens, FormatIds, FormatRanges, FormatCSV, FormatGeoJSON:
+		return s, nil
+	}
+	return "", ErrInvalidFormat
+}
+
+// coveringSet is a covering along with the kind of covering it is.
+type coveringSet struct {
+	kind  string
+	cells []s2.CellID
+}
+
+type byCellID []s2.CellID
+
+func (s byCellID) Len() int           { return len(s) }
+func (s byCellID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byCellID) Less(i, j int) bool { return s[i] < s[j] }
+
+// normalizeCovering turns ids into a normalized cell union, merging
+// cells that cover their parent, and then splits cells coarser than
+// minLevel or off levelMod again so the result still obeys the coverer
+// options. The result is sorted.
+func normalizeCovering(ids []s2.CellID, minLevel, levelMod int) []s2.CellID {
+	var union s2.CellUnion
+	union.Init(ids)
+	var covering []s2.CellID
+	union.Denormalize(minLevel, levelMod, &covering)
+	return covering
+}
+
+type byRangeMin []s2.CellID
+
+func (s byRangeMin) Len() int           { return len(s) }
+func (s byRangeMin) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byRangeMin) Less(i, j int) bool { return s[i].RangeMin() < s[j].RangeMin() }
+
+// leafRanges returns the leaf cell ID intervals covered by ids, sorted
+// and with adjacent or overlapping intervals merged.
+func leafRanges(ids []s2.CellID) [][2]s2.CellID {
+	sorted := append([]s2.CellID{}, ids...)
+	sort.Sort(byRangeMin(sorted))
+	var ranges [][2]s2.CellID
+	for _, id := range sorted {
+		lo, hi := id.RangeMin(), id.RangeMax()
+		if n := len(ranges); n > 0 && lo <= ranges[n-1][1].Next() {
+			if hi > ranges[n-1][1] {
+				ranges[n-1][1] = hi
+			}
+			continue
+		}
+		ranges = append(ranges, [2]s2.CellID{lo, hi})
+	}
+	return ranges
+}
+
+func formatCells(ids []s2.CellID, format string) interface{} {
+	switch format {
+	case FormatTokens:
+		tokens := make([]string, len(ids))
+		for i, id := range ids {
+			tokens[i] = id.ToToken()
+		}
+		return tokens
+	case FormatIds:
+		// Decimal strings, since JSON numbers lose precision above 2^53.
+		decimal := make([]string, len(ids))
+		for i, id := range ids {
+			decimal[i] = strconv.FormatUint(uint64(id), 10)
+		}
+		return decimal
+	case FormatRanges:
+		ranges := [][2]string{}
+		for _, r := range leafRanges(ids) {
+			ranges = append(ranges, [2]string{
+				strconv.FormatUint(uint64(r[0]), 10),
+				strconv.FormatUint(uint64(r[1]), 10),
+			})
+		}
+		return ranges
+	}
+	return cellIdsToCovering(ids)
+}
+
+// formatCoverings renders sets in one of the JSON formats. The full
+// format is a single list of cells, tagged with their covering kind if
+// tagged is set. Other formats return a bare list for a single covering
+// and an object keyed by covering kind otherwise.
+func formatCoverings(sets []coveringSet, format string, tagged bool) interface{} {
+	if format == FormatFull {
+		cells := []CellIDJSON{}
+		for _, set := range sets {
+			c := cellIdsToCovering(set.cells)
+			if tagged {
+				tagCovering(c, set.kind)
+			}
+			cells = append(cells, c...)
+		}
+		return cells
+	}
+	if len(sets) == 1 {
+		return formatCells(sets[0].cells, format)
+	}
+	byKind := make(map[string]interface{})
+	for _, set := range sets {
+		byKind[set.kind] = formatCells(set.cells, format)
+	}
+	return byKind
+}
+
+// featureCoverings holds the coverings of one feature, or of the whole
+// input when the feature index is -1.
+type featureCoverings struct {
+	feature feature
+	sets    []coveringSet
+}
+
+type featureCoveringJSON struct {
+	Feature    int                    `json:"feature"`
+	Id         interface{}            `json:"id,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+	Cells      interface{}            `json:"cells"`
+}
+
+// writeCoveringCSV writes one row per cell, with a header row. Rows
+// start with the feature index if perFeature is set.
+func writeCoveringCSV(w io.Writer, groups []featureCoverings, tagged, perFeature bool) error {
+	cw := csv.NewWriter(w)
+	header := []string{"token", "id", "id_signed", "level", "face", "lat", "lng"}
+	if perFeature {
+		header = append([]string{"feature"}, header...)
+	}
+	if tagged {
+		header = append(header, "covering")
+	}
+	cw.Write(header)
+	for _, g := range groups {
+		for _, set := range g.sets {
+			for _, c := range cellIdsToCovering(set.cells) {
+				var row []string
+				if perFeature {
+					row = append(row, strconv.Itoa(g.feature.index))
+				}
+				row = append(row,
+					c.Token,
+					c.Id,
+					c.IdSigned,
+					strconv.Itoa(c.Level),
+					strconv.Itoa(c.Face),
+					strconv.FormatFloat(c.LL.Lat, 'f', -1, 64),
+					strconv.FormatFloat(c.LL.Lng, 'f', -1, 64),
+				)
+				if tagged {
+					row = append(row, set.kind)
+				}
+				cw.Write(row)
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func cellPolygon(id s2.CellID) *s2.Polygon {
+	cell := s2.CellFromCellID(id)
+	points := make([]s2.Point, 4)
+	for i := range points {
+		points[i] = cell.Vertex(i)
+	}
+	return polygonFromPath(points)
+}
+
+// coveringToGeoJSON returns one Polygon feature per cell, or with
+// dissolve set a single outline per covering, made by unioning the cells.
+func coveringToGeoJSON(groups []featureCoverings, tagged, perFeature, dissolve bool) *geojson.FeatureCollection {
+	fc := &geojson.FeatureCollection{
+		Typ:      "FeatureCollection",
+		Features: []geojson.Feature{},
+	}
+	for _, g := range groups {
+		for _, set := range g.sets {
+			properties := func() map[string]interface{} {
+				p := make(map[string]interface{})
+				if perFeature {
+					p["feature"] = g.feature.index
+				}
+				if tagged {
+					p["covering"] = set.kind
+				}
+				return p
+			}
+			if dissolve {
+				polygons := make([]*s2.Polygon, len(set.cells))
+				for i, id := range set.cells {
+					polygons[i] = cellPolygon(id)
+				}
+				fc.Features = append(fc.Features, geojson.Feature{
+					Typ:        "Feature",
+					Properties: properties(),
+					Geometry:   s2PolygonToGeometry(*unionAll(polygons)),
+				})
+				continue
+			}
+			for _, id := range set.cells {
+				p := properties()
+				p["token"] = id.ToToken()
+				p["level"] = id.Level()
+				fc.Features = append(fc.Features, geojson.Feature{
+					Typ:        "Feature",
+					Properties: p,
+					Geometry:   s2PolygonToGeometry(*cellPolygon(id)),
+				})
+			}
+		}
+	}
+	return fc
+}
+
+// tagCovering marks every cell with the kind of covering it belongs to.
+func tagCovering(cells []CellIDJSON, kind string) []CellIDJSON {
+	for i := range cells {
+		cells[i].Covering = kind
+	}
+	return cells
+}
+
+// maxUniformCells caps the size of a fixed-level covering, since every
+// level a cell is expanded by multiplies its cell count by four.
+const maxUniformCells = 100000
+
+// uniformCovering replaces every cell in covering by its descendants at
+// level, or by its ancestor at level if it is finer.
+func uniformCovering(covering []s2.CellID, level int) ([]s2.CellID, error) {
+	if level < 0 || level > s2.MaxCellLevel {
+		return nil, ErrInvalidLevel
+	}
+	// Count first so a huge expansion fails before allocating anything.
+	total := uint64(0)
+	for _, c := range covering {
+		if d := level - c.Level(); d > 0 {
+			total += uint64(1) << uint(2*d)
+		} else {
+			total++
+		}
+		if total > maxUniformCells {
+			return nil, ErrTooManyCells
+		}
+	}
+	seen := make(map[s2.CellID]struct{})
+	uniform := make([]s2.CellID, 0, total)
+	add := func(id s2.CellID) {
+		if _, ok := seen[id]; !ok {
+			seen[id] = struct{}{}
+			uniform = append(uniform, id)
+		}
+	}
+	for _, c := range covering {
+		if c.Level() >= level {
+			add(c.Parent(level))
+			continue
+		}
+		end := c.ChildEndAtLevel(level)
+		for id := c.ChildBeginAtLevel(level); id != end; id = id.Next() {
+			add(id)
+		}
+	}
+	return uniform, nil
+}
+
+// sortCovering puts ids in CellID order so responses are deterministic.
+func sortCovering(ids []s2.CellID) {
+	sort.Sort(byCellID(ids))
+}
+
+// CoveringStats describes how closely a covering fits the region it
+// covers. Feature is -1 for a covering of the whole input. OverCoverage is
+// the covering area over the region area, and is 0 when the region has no
+// area. Interior cells lie entirely inside the region; all cells of a
+// region without polygons count as boundary cells.
+type CoveringStats struct {
+	Feature       int         `json:"feature"`
+	Covering      string      `json:"covering"`
+	Cells         int         `json:"cells"`
+	CoveringArea  float64     `json:"covering_area_m2"`
+	RegionArea    float64     `json:"region_area_m2"`
+	OverCoverage  float64     `json:"over_coverage"`
+	Levels        map[int]int `json:"levels"`
+	InteriorCells int         `json:"interior_cells"`
+	BoundaryCells int         `json:"boundary_cells"`
+	LeafRanges    int         `json:"leaf_ranges"`
+}
+
+// regionPolygon returns the union of the polygonal parts of features, or
+// nil if there are none.
+func regionPolygon(features []feature) (*s2.Polygon, error) {
+	var polygons []*s2.Polygon
+	for _, f := range features {
+		poly, err := geometryToS2Polygon(f.geometry)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		if poly != nil {
+			polygons = append(polygons, poly)
+		}
+	}
+	if len(polygons) == 0 {
+		return nil, nil
+	}
+	return unionAll(polygons), nil
+}
+
+func coveringStats(region *s2.Polygon, set coveringSet, featureIndex int) CoveringStats {
+	stats := CoveringStats{
+		Feature:    featureIndex,
+		Covering:   set.kind,
+		Cells:      len(set.cells),
+		Levels:     make(map[int]int),
+		LeafRanges: len(leafRanges(set.cells)),
+	}
+	for _, id := range set.cells {
+		stats.Levels[id.Level()]++
+		if region != nil && region.ContainsCell(s2.CellFromCellID(id)) {
+			stats.InteriorCells++
+		} else {
+			stats.BoundaryCells++
+		}
+	}
+	// Measure the normalized union so overlapping cells of an
+	// unnormalized covering aren't counted twice.
+	for _, id := range normalizeCovering(set.cells, 0, 1) {
+		stats.CoveringArea += s2.CellFromCellID(id).ExactArea() * earthRadiusMeters * earthRadiusMeters
+	}
+	if region != nil {
+		stats.RegionArea = region.Area() * earthRadiusMeters * earthRadiusMeters
+	}
+	if stats.RegionArea > 0 {
+		stats.OverCoverage = stats.CoveringArea / stats.RegionArea
+	}
+	return stats
+}
+
+// coverOptions holds the /a/s2cover parameters. fixedLevel is -1 unless
+// a uniform covering was asked for.
+type coverOptions struct {
+	minLevel          int
+	maxLevel          int
+	maxCells          int
+	levelMod          int
+	fixedLevel        int
+	coveringType      string
+	format            string
+	simplifyTolerance float64
+	normalize         bool
+	perFeature        bool
+	repair            bool
+	stats             bool
+	dissolve          bool
+}
+
+func parseCoverOptions(r *http.Request) (coverOptions, error) {
+	opts := coverOptions{
+		minLevel:   1,
+		maxLevel:   s2.MaxCellLevel,
+		maxCells:   8,
+		levelMod:   1,
+		fixedLevel: -1,
+		normalize:  r.FormValue("normalize") != "false",
+		perFeature: r.FormValue("per_feature") == "true",
+		repair:     r.FormValue("repair") == "true",
+		dissolve:   r.FormValue("dissolve") == "true",
+	}
+	for name, v := range map[string]*int{
+		"min_level": &opts.minLevel,
+		"max_level": &opts.maxLevel,
+		"max_cells": &opts.maxCells,
+		"level_mod": &opts.levelMod,
+	} {
+		if n, err := strconv.Atoi(r.FormValue(name)); err == nil {
+			*v = n
+		}
+	}
+	if t, err := strconv.ParseFloat(r.FormValue("simplify_tolerance"), 64); err == nil {
+		opts.simplifyTolerance = t
+	}
+	var err error
+	if opts.coveringType, err = parseCoveringType(r.FormValue("covering_type")); err != nil {
+		return opts, err
+	}
+	if opts.format, err = parseCoverFormat(r.FormValue("format")); err != nil {
+		return opts, err
+	}
+	// A fixed level asks for every cell at exactly that level, so there
+	// is no point in letting the coverer go any finer.
+	if level, err := strconv.Atoi(r.FormValue("level")); err == nil {
+		if level < 0 || level > s2.MaxCellLevel {
+			return opts, ErrInvalidLevel
+		}
+		opts.fixedLevel = level
+		opts.maxLevel = level
+		if opts.minLevel > level {
+			opts.minLevel = level
+		}
+	}
+	// Stats are only part of the JSON envelope, so CSV output leaves
+	// them out.
+	opts.stats = r.FormValue("stats") == "true" && opts.format != FormatCSV
+	return opts, nil
+}
+
+// tagged reports whether cells are tagged with their covering kind.
+// Plain exterior coverings keep their untagged cells.
+func (opts coverOptions) tagged() bool {
+	return opts.coveringType != CoveringExterior
+}
+
+// cover returns the sorted covering of features of one kind.
+//
+// A fixed level covering starts from the coarse exterior covering, whose
+// expansion to the fixed level bounds any covering at that level, and
+// only runs a coverer pinned to the level once that expansion is known
+// to fit in maxUniformCells. Pinning straight away would let the coverer
+// subdivide a large region without limit.
+func (opts coverOptions) cover(coverer *s2.RegionCoverer, features []feature, interior bool) ([]s2.CellID, error) {
+	pointLevel := pointCoveringLevel(opts.minLevel, opts.maxLevel, opts.levelMod)
+	if opts.fixedLevel >= 0 {
+		coarse, err := coverFeatures(coverer, features, pointLevel, false)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := uniformCovering(coarse, opts.fixedLevel); err != nil {
+			return nil, err
+		}
+		coverer = s2.NewRegionCoverer()
+		coverer.SetMinLevel(opts.fixedLevel)
+		coverer.SetMaxLevel(opts.fixedLevel)
+		coverer.SetMaxCells(opts.maxCells)
+		pointLevel = opts.fixedLevel
+	}
+	covering, err := coverFeatures(coverer, features, pointLevel, interior)
+	if err != nil {
+		return nil, err
+	}
+	if opts.normalize {
+		covering = normalizeCovering(covering, opts.minLevel, opts.levelMod)
+	}
+	if opts.fixedLevel >= 0 {
+		covering, err = uniformCovering(covering, opts.fixedLevel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sortCovering(covering)
+	return covering, nil
+}
+
+// coverSets returns the coverings of features asked for by coveringType.
+func (opts coverOptions) coverSets(coverer *s2.RegionCoverer, features []feature) ([]coveringSet, error) {
+	var sets []coveringSet
+	if opts.coveringType != CoveringInterior {
+		covering, err := opts.cover(coverer, features, false)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, coveringSet{CoveringExterior, covering})
+	}
+	if opts.coveringType != CoveringExterior {
+		covering, err := opts.cover(coverer, features, true)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, coveringSet{CoveringInterior, covering})
+	}
+	return sets, nil
+}
+
+// ownFeatures returns f as a list to cover on its own, which is empty if
+// f has no geometry.
+func ownFeatures(f feature) []feature {
+	if f.geometry == nil {
+		return nil
+	}
+	return []feature{f}
+}
+
+type coverResult struct {
+	normalized bool
+	groups     []featureCoverings
+	stats      []CoveringStats
+	repairs    []Repair
+}
+
+// coverGeoJSON repairs and simplifies js if asked to and covers it,
+// either as a whole or one feature at a time.
+func coverGeoJSON(js geojson.GeoJSON, opts coverOptions) (*coverResult, error) {
+	result := &coverResult{normalized: opts.normalize}
+	if opts.repair {
+		js, result.repairs = RepairGeometry(js)
+		if result.repairs == nil {
+			result.repairs = []Repair{}
+		}
+	}
+	if opts.simplifyTolerance > 0 {
+		simplified, err := Simplify(js, opts.simplifyTolerance)
+		if err != nil {
+			return nil, err
+		}
+		js = *simplified
+	}
+	coverer := s2.NewRegionCoverer()
+	coverer.SetMinLevel(opts.minLevel)
+	coverer.SetMaxLevel(opts.maxLevel)
+	coverer.SetLevelMod(opts.levelMod)
+	coverer.SetMaxCells(opts.maxCells)
+	features := flattenGeoJSON(js)
+	if opts.perFeature {
+		// Every input feature gets an entry, empty for features without
+		// a geometry, so the result runs parallel to the input.
+		for _, f := range allFeatures(js) {
+			sets, err := opts.coverSets(coverer, ownFeatures(f))
+			if err != nil {
+				return nil, err
+			}
+			result.groups = append(result.groups, featureCoverings{f, sets})
+		}
+	} else {
+		sets, err := opts.coverSets(coverer, features)
+		if err != nil {
+			return nil, err
+		}
+		result.groups = append(result.groups, featureCoverings{feature{index: -1}, sets})
+	}
+	if opts.stats {
+		for _, g := range result.groups {
+			regionFeatures := features
+			if g.feature.index >= 0 {
+				regionFeatures = ownFeatures(g.feature)
+			}
+			region, err := regionPolygon(regionFeatures)
+			if err != nil {
+				return nil, err
+			}
+			for _, set := range g.sets {
+				result.stats = append(result.stats, coveringStats(region, set, g.feature.index))
+			}
+		}
+	}
+	return result, nil
+}
+
+// response returns the JSON body for result. The cells are a
+// FeatureCollection for the geojson format, a list with one entry per
+// feature when per feature, and otherwise whatever formatCoverings makes
+// of the covering. They are wrapped in a coverResponse only when repairs
+// or stats were asked for, so the default response stays a bare list.
+func (result *coverResult) response(opts coverOptions) interface{} {
+	var cells interface{}
+	switch {
+	case opts.format == FormatGeoJSON:
+		cells = coveringToGeoJSON(result.groups, opts.tagged(), opts.perFeature, opts.dissolve)
+	case opts.perFeature:
+		coverings := []featureCoveringJSON{}
+		for _, g := range result.groups {
+			coverings = append(coverings, featureCoveringJSON{
+				Feature:    g.feature.index,
+				Id:         g.feature.id,
+				Properties: g.feature.properties,
+				Cells:      formatCoverings(g.sets, opts.format, opts.tagged()),
+			})
+		}
+		cells = coverings
+	default:
+		cells = formatCoverings(result.groups[0].sets, opts.format, opts.tagged())
+	}
+	if !opts.repair && !opts.stats {
+		return cells
+	}
+	resp := coverResponse{
+		Cells:      cells,
+		Normalized: result.normalized,
+		Stats:      result.stats,
+	}
+	if opts.repair {
+		resp.Repairs = &result.repairs
+	}
+	return resp
+}
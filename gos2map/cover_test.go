@@ -0,0 +1,45 @@
+package gos2map
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/davidreynolds/gos2/s2"
+)
+
+func TestLeafRanges(t *testing.T) {
+	parent := s2.CellIDFromLatLng(s2.LatLngFromDegrees(40.7, -74)).Parent(10)
+	c0 := parent.ChildBegin()
+	c1 := c0.Next()
+	c2 := c1.Next()
+	c3 := c2.Next()
+	tests := []struct {
+		name string
+		ids  []s2.CellID
+		want [][2]s2.CellID
+	}{
+		{"empty", nil, nil},
+		{"single cell", []s2.CellID{c1}, [][2]s2.CellID{{c1.RangeMin(), c1.RangeMax()}}},
+		{"adjacent cells merge", []s2.CellID{c0, c1}, [][2]s2.CellID{{c0.RangeMin(), c1.RangeMax()}}},
+		{"gap keeps ranges apart", []s2.CellID{c0, c2}, [][2]s2.CellID{
+			{c0.RangeMin(), c0.RangeMax()},
+			{c2.RangeMin(), c2.RangeMax()},
+		}},
+		{"unsorted input", []s2.CellID{c3, c0, c2}, [][2]s2.CellID{
+			{c0.RangeMin(), c0.RangeMax()},
+			{c2.RangeMin(), c3.RangeMax()},
+		}},
+		{"contained cell", []s2.CellID{c1.ChildBegin(), parent}, [][2]s2.CellID{
+			{parent.RangeMin(), parent.RangeMax()},
+		}},
+		{"overlap extends range", []s2.CellID{c0, c1.ChildBegin(), c1}, [][2]s2.CellID{
+			{c0.RangeMin(), c1.RangeMax()},
+		}},
+		{"duplicates", []s2.CellID{c2, c2}, [][2]s2.CellID{{c2.RangeMin(), c2.RangeMax()}}},
+	}
+	for _, tt := range tests {
+		if got := leafRanges(tt.ids); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: leafRanges = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
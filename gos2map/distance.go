@@ -0,0 +1,176 @@
+package gos2map
+
+import (
+	"math"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// DistanceResult is the minimum distance between two inputs and the
+// closest pair of points realizing it. A and B are the indexes of the
+// features those points lie on.
+type DistanceResult struct {
+	A        int     `json:"a"`
+	B        int     `json:"b"`
+	Meters   float64 `json:"meters"`
+	ClosestA LatLng  `json:"closest_a"`
+	ClosestB LatLng  `json:"closest_b"`
+}
+
+// distanceShape is a feature reduced to the parts distance cares about:
+// its interior, its edges and its isolated points.
+type distanceShape struct {
+	index  int
+	poly   *s2.Polygon
+	edges  [][2]s2.Point
+	points []s2.Point
+}
+
+// vertices returns the isolated points and edge endpoints of s.
+func (s distanceShape) vertices() []s2.Point {
+	vertices := append([]s2.Point{}, s.points...)
+	for _, e := range s.edges {
+		vertices = append(vertices, e[0], e[1])
+	}
+	return vertices
+}
+
+func featureDistanceShape(f feature) (distanceShape, error) {
+	s := distanceShape{index: f.index}
+	poly, err := geometryToS2Polygon(f.geometry)
+	if err != nil {
+		return s, err
+	}
+	if poly != nil && poly.NumLoops() > 0 {
+		s.poly = poly
+		for i := 0; i < poly.NumLoops(); i++ {
+			loop := loopPoints(poly.Loop(i))
+			for j := range loop {
+				s.edges = append(s.edges, [2]s2.Point{loop[j], loop[(j+1)%len(loop)]})
+			}
+		}
+	}
+	for _, line := range lineStringPoints(f.geometry) {
+		if len(line) == 1 {
+			s.points = append(s.points, line[0])
+		}
+		for j := 1; j < len(line); j++ {
+			s.edges = append(s.edges, [2]s2.Point{line[j-1], line[j]})
+		}
+	}
+	s.points = append(s.points, geometryToS2Points(f.geometry)...)
+	if s.poly == nil && len(s.edges) == 0 && len(s.points) == 0 {
+		return s, ErrUnsupportedGeometry
+	}
+	return s, nil
+}
+
+// touching returns a point shared by a and b, if there is one.
+func touching(a, b distanceShape) (s2.Point, bool) {
+	if a.poly != nil {
+		for _, p := range b.vertices() {
+			if a.poly.ContainsPoint(p) {
+				return p, true
+			}
+		}
+	}
+	if b.poly != nil {
+		for _, p := range a.vertices() {
+			if b.poly.ContainsPoint(p) {
+				return p, true
+			}
+		}
+	}
+	for _, ea := range a.edges {
+		for _, eb := range b.edges {
+			if edgesCross(ea[0], ea[1], eb[0], eb[1]) {
+				return edgeIntersection(ea[0], ea[1], eb[0], eb[1]), true
+			}
+		}
+	}
+	return s2.Point{}, false
+}
+
+// nearest returns the closest pair of points between the vertices of a
+// and the points and edges of b, with the point on a first.
+func nearest(a, b distanceShape) (float64, s2.Point, s2.Point) {
+	best := math.Inf(1)
+	var pa, pb s2.Point
+	for _, x := range a.vertices() {
+		for _, y := range b.points {
+			if d := float64(x.Angle(y.Vector)); d < best {
+				best, pa, pb = d, x, y
+			}
+		}
+		for _, e := range b.edges {
+			y := closestPoint(x, e[0], e[1])
+			if d := float64(x.Angle(y.Vector)); d < best {
+				best, pa, pb = d, x, y
+			}
+		}
+	}
+	return best, pa, pb
+}
+
+func shapeDistance(a, b distanceShape) (float64, s2.Point, s2.Point) {
+	if p, ok := touching(a, b); ok {
+		return 0, p, p
+	}
+	d, pa, pb := nearest(a, b)
+	if d2, qb, qa := nearest(b, a); d2 < d {
+		d, pa, pb = d2, qa, qb
+	}
+	return d, pa, pb
+}
+
+func distanceShapes(features []feature) ([]distanceShape, error) {
+	shapes := make([]distanceShape, len(features))
+	for i, f := range features {
+		s, err := featureDistanceShape(f)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		shapes[i] = s
+	}
+	return shapes, nil
+}
+
+func distanceFeatures(as, bs []feature) (*DistanceResult, error) {
+	if len(as) == 0 || len(bs) == 0 {
+		return nil, ErrNoPolygons
+	}
+	sa, err := distanceShapes(as)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := distanceShapes(bs)
+	if err != nil {
+		return nil, err
+	}
+	var result *DistanceResult
+	for _, a := range sa {
+		for _, b := range sb {
+			d, pa, pb := shapeDistance(a, b)
+			meters := d * earthRadiusMeters
+			if result != nil && meters >= result.Meters {
+				continue
+			}
+			result = &DistanceResult{
+				A:        a.index,
+				B:        b.index,
+				Meters:   meters,
+				ClosestA: latLngFromPoint(pa),
+				ClosestB: latLngFromPoint(pb),
+			}
+		}
+	}
+	return result, nil
+}
+
+// Distance returns the minimum great-circle distance between a and b,
+// which may be any mix of points, lines and polygons. Overlapping inputs
+// are at distance zero.
+func Distance(a, b geojson.GeoJSON) (*DistanceResult, error) {
+	return distanceFeatures(flattenGeoJSON(a), flattenGeoJSON(b))
+}
@@ -0,0 +1,54 @@
+package gos2map
+
+import (
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// edgesCross reports whether edge AB crosses edge CD at a point interior
+// to both edges. Edges that only share a vertex do not cross.
+func edgesCross(a, b, c, d s2.Point) bool {
+	ab := a.Cross(b.Vector)
+	acb := -ab.Dot(c.Vector)
+	bda := ab.Dot(d.Vector)
+	if acb*bda <= 0 {
+		return false
+	}
+	cd := c.Cross(d.Vector)
+	cbd := -cd.Dot(b.Vector)
+	dac := cd.Dot(a.Vector)
+	return acb*cbd > 0 && acb*dac > 0
+}
+
+// edgeIntersection returns the point where crossing edges AB and CD meet.
+func edgeIntersection(a, b, c, d s2.Point) s2.Point {
+	x := a.Cross(b.Vector).Cross(c.Cross(d.Vector)).Normalize()
+	// The great circles meet at two antipodal points; pick the one near
+	// the edges.
+	if x.Dot(a.Add(b.Vector).Add(c.Vector).Add(d.Vector)) < 0 {
+		x = x.Mul(-1)
+	}
+	return s2.Point{Vector: x}
+}
+
+// closestPoint returns the point on edge AB closest to x.
+func closestPoint(x, a, b s2.Point) s2.Point {
+	n := a.Cross(b.Vector)
+	if n.Norm() > 0 {
+		// Project x onto the great circle through AB and keep the
+		// projection if it falls between the endpoints.
+		unit := n.Normalize()
+		p := x.Sub(unit.Mul(x.Dot(unit)))
+		if p.Norm() > 0 && a.Cross(p).Dot(n) >= 0 && p.Cross(b.Vector).Dot(n) >= 0 {
+			return s2.Point{Vector: p.Normalize()}
+		}
+	}
+	if x.Angle(a.Vector) <= x.Angle(b.Vector) {
+		return a
+	}
+	return b
+}
+
+// distanceToEdge returns the angle in radians between x and edge AB.
+func distanceToEdge(x, a, b s2.Point) float64 {
+	return float64(x.Angle(closestPoint(x, a, b).Vector))
+}
@@ -0,0 +1,77 @@
+package gos2map
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNoPolygons          = errors.New("no polygons in input")
+	ErrTooFewOperands      = errors.New("too few polygons for operation")
+	ErrInvalidRing         = errors.New("ring has fewer than 3 distinct vertices")
+	ErrUnsupportedGeometry = errors.New("unsupported geometry type")
+	ErrInvalidMode         = errors.New("invalid mode")
+	ErrInvalidThreshold    = errors.New("threshold must be at least 1")
+	ErrInvalidDistance     = errors.New("invalid distance")
+	ErrNotInHemisphere     = errors.New("geometry does not fit in a hemisphere")
+	ErrInvalidRequest      = errors.New("invalid request")
+	ErrFeatureIndex        = errors.New("feature index out of range")
+	ErrTooManyCells        = errors.New("covering has too many cells")
+	ErrInvalidLevel        = errors.New("invalid cell level")
+	ErrInvalidCell         = errors.New("invalid cell id")
+	ErrInvalidFormat       = errors.New("invalid format parameter")
+	ErrInvalidCoveringType = errors.New("invalid covering_type parameter")
+	ErrInvalidNeighborType = errors.New("invalid neighbor type parameter")
+)
+
+// FeatureError records which input feature caused an error. Index is
+// the position of the feature in the flattened input.
+type FeatureError struct {
+	Index int
+	Err   error
+}
+
+func (e *FeatureError) Error() string {
+	return fmt.Sprintf("feature %d: %v", e.Index, e.Err)
+}
+
+type errorJSON struct {
+	Error   string `json:"error"`
+	Feature *int   `json:"feature,omitempty"`
+}
+
+// isInputError reports whether err is caused by bad input rather than a
+// failure on our side.
+func isInputError(err error) bool {
+	if ferr, ok := err.(*FeatureError); ok {
+		err = ferr.Err
+	}
+	switch err {
+	case ErrNoPolygons, ErrTooFewOperands, ErrInvalidRing, ErrUnsupportedGeometry,
+		ErrInvalidMode, ErrInvalidThreshold, ErrInvalidDistance, ErrNotInHemisphere,
+		ErrInvalidRequest, ErrFeatureIndex, ErrTooManyCells, ErrInvalidLevel,
+		ErrInvalidCell, ErrInvalidFormat, ErrInvalidCoveringType, ErrInvalidNeighborType:
+		return true
+	}
+	return false
+}
+
+// writeError responds with a 400 and a JSON body for input errors and
+// falls back to a plain 500 for everything else.
+func writeError(w http.ResponseWriter, err error) {
+	if !isInputError(err) {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := errorJSON{Error: err.Error()}
+	if ferr, ok := err.(*FeatureError); ok {
+		body.Error = ferr.Err.Error()
+		body.Feature = &ferr.Index
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Del("Content-Encoding")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(body)
+}
@@ -5,24 +5,144 @@ import (
 	"github.com/davidreynolds/gos2/s2"
 )
 
-func geometryToS2Polygon(geom geojson.GeoJSON) (*s2.Polygon, error) {
-	var poly *s2.Polygon
-	builder := s2.NewPolygonBuilder(s2.DIRECTED_XOR())
+// earthRadiusMeters is the mean radius of the Earth used to convert
+// between angles on the unit sphere and distances on the ground.
+const earthRadiusMeters = 6371010.0
+
+func metersToAngle(meters float64) float64 {
+	return meters / earthRadiusMeters
+}
+
+func sameCoordinate(a, b geojson.Coordinate) bool {
+	return a[0] == b[0] && a[1] == b[1]
+}
+
+func loopFromRing(ring []geojson.Coordinate) (*s2.Loop, error) {
+	var points []s2.Point
+	distinct := 0
+	for i, v := range ring {
+		if i == 0 || !sameCoordinate(v, ring[i-1]) {
+			distinct++
+		}
+		points = append(points, coordinateToS2Point(v))
+	}
+	// A closed ring repeats its first vertex at the end.
+	if distinct > 1 && sameCoordinate(ring[0], ring[len(ring)-1]) {
+		distinct--
+	}
+	if distinct < 3 {
+		return nil, ErrInvalidRing
+	}
+	return s2.NewLoopFromPath(points), nil
+}
+
+// addPolygonLoops adds the rings of every polygonal geometry in geom to
+// builder and reports whether there were any.
+func addPolygonLoops(builder *s2.PolygonBuilder, geom geojson.GeoJSON) (bool, error) {
+	var rings [][]geojson.Coordinate
+	found := false
 	switch geom := geom.(type) {
 	case geojson.Polygon:
-		for _, ring := range geom.Coordinates {
-			var points []s2.Point
-			for _, v := range ring {
-				points = append(points, s2.PointFromLatLng(s2.LatLngFromDegrees(v[1], v[0])))
+		rings = geom.Coordinates
+		found = true
+	case geojson.MultiPolygon:
+		// All member rings go into one builder so the members come out
+		// as the shells of a single polygon.
+		for _, polygon := range geom.Coordinates {
+			rings = append(rings, polygon...)
+		}
+		found = true
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			ok, err := addPolygonLoops(builder, g)
+			if err != nil {
+				return false, err
 			}
-			builder.AddLoop(s2.NewLoopFromPath(points))
+			found = found || ok
 		}
+	}
+	for _, ring := range rings {
+		loop, err := loopFromRing(ring)
+		if err != nil {
+			return false, err
+		}
+		builder.AddLoop(loop)
+	}
+	return found, nil
+}
+
+// geometryToS2Polygon returns nil if geom has no polygonal parts.
+func geometryToS2Polygon(geom geojson.GeoJSON) (*s2.Polygon, error) {
+	var poly *s2.Polygon
+	builder := s2.NewPolygonBuilder(s2.DIRECTED_XOR())
+	found, err := addPolygonLoops(builder, geom)
+	if err != nil {
+		return nil, err
+	}
+	if found {
 		poly = new(s2.Polygon)
 		builder.AssemblePolygon(poly, nil)
 	}
 	return poly, nil
 }
 
+func coordinateToS2Point(v geojson.Coordinate) s2.Point {
+	return s2.PointFromLatLng(s2.LatLngFromDegrees(v[1], v[0]))
+}
+
+func latLngFromPoint(p s2.Point) LatLng {
+	ll := s2.LatLngFromPoint(p)
+	return LatLng{Lat: ll.Lat.Degrees(), Lng: ll.Lng.Degrees()}
+}
+
+func geometryToS2Points(geom geojson.GeoJSON) []s2.Point {
+	var points []s2.Point
+	switch geom := geom.(type) {
+	case geojson.Point:
+		points = append(points, coordinateToS2Point(geom.Coordinates))
+	case geojson.MultiPoint:
+		for _, v := range geom.Coordinates {
+			points = append(points, coordinateToS2Point(v))
+		}
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			points = append(points, geometryToS2Points(g)...)
+		}
+	}
+	return points
+}
+
+func lineStringPoints(geom geojson.GeoJSON) [][]s2.Point {
+	var lines [][]geojson.Coordinate
+	var paths [][]s2.Point
+	switch geom := geom.(type) {
+	case geojson.LineString:
+		lines = append(lines, geom.Coordinates)
+	case geojson.MultiLineString:
+		lines = geom.Coordinates
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			paths = append(paths, lineStringPoints(g)...)
+		}
+	}
+	for _, line := range lines {
+		var points []s2.Point
+		for _, v := range line {
+			points = append(points, coordinateToS2Point(v))
+		}
+		paths = append(paths, points)
+	}
+	return paths
+}
+
+func geometryToS2Polylines(geom geojson.GeoJSON) []*s2.Polyline {
+	var polylines []*s2.Polyline
+	for _, points := range lineStringPoints(geom) {
+		polylines = append(polylines, s2.NewPolyline(points))
+	}
+	return polylines
+}
+
 func s2PolygonToGeometry(poly s2.Polygon) *geojson.Polygon {
 	// Don't want nil rings for coordinates.
 	rings := [][]geojson.Coordinate{}
@@ -38,28 +158,156 @@ func s2PolygonToGeometry(poly s2.Polygon) *geojson.Polygon {
 	return &geojson.Polygon{Typ: "Polygon", Coordinates: rings}
 }
 
-func geometryToPolygonList(js geojson.GeoJSON) ([]*s2.Polygon, error) {
-	var polygons []*s2.Polygon
-	switch js := js.(type) {
-	case geojson.FeatureCollection:
-		for _, feature := range js.Features {
-			geom := feature.Geometry
-			poly, err := geometryToS2Polygon(geom)
-			if err != nil {
-				return nil, err
+// feature is a single input geometry along with the feature it came
+// from. index is the position of the feature in the flattened input,
+// counting features without a geometry even though they are dropped.
+type feature struct {
+	index      int
+	id         interface{}
+	properties map[string]interface{}
+	geometry   geojson.GeoJSON
+}
+
+// allFeatures normalizes any top-level GeoJSON object into a list of
+// features. Bare geometries become features without properties and
+// collections, nested or not, contribute one feature per member.
+// Features without a geometry are kept, with a nil geometry, so that
+// code rebuilding a collection keeps every feature in place.
+func allFeatures(js geojson.GeoJSON) []feature {
+	var features []feature
+	var walk func(js geojson.GeoJSON)
+	walk = func(js geojson.GeoJSON) {
+		switch js := js.(type) {
+		case nil:
+		case geojson.FeatureCollection:
+			for _, f := range js.Features {
+				walk(f)
 			}
-			if poly != nil {
-				polygons = append(polygons, poly)
+		case geojson.Feature:
+			features = append(features, feature{
+				index:      len(features),
+				id:         js.Id,
+				properties: js.Properties,
+				geometry:   js.Geometry,
+			})
+		case geojson.GeometryCollection:
+			for _, g := range js.Geometries {
+				walk(g)
 			}
+		default:
+			features = append(features, feature{
+				index:    len(features),
+				geometry: js,
+			})
+		}
+	}
+	walk(js)
+	return features
+}
+
+// flattenGeoJSON returns the features of js that have a geometry.
+func flattenGeoJSON(js geojson.GeoJSON) []feature {
+	var features []feature
+	for _, f := range allFeatures(js) {
+		if f.geometry != nil {
+			features = append(features, f)
+		}
+	}
+	return features
+}
+
+// geometryToPolygonList returns the polygon for every input feature
+// together with the features themselves, in the same order.
+func geometryToPolygonList(js geojson.GeoJSON) ([]*s2.Polygon, []feature, error) {
+	var polygons []*s2.Polygon
+	features := flattenGeoJSON(js)
+	for _, f := range features {
+		poly, err := geometryToS2Polygon(f.geometry)
+		if err != nil {
+			return nil, nil, &FeatureError{Index: f.index, Err: err}
+		}
+		if poly == nil {
+			return nil, nil, &FeatureError{Index: f.index, Err: ErrUnsupportedGeometry}
 		}
+		polygons = append(polygons, poly)
 	}
-	return polygons, nil
+	return polygons, features, nil
 }
 
-func featureCollectionFromS2Polygon(poly *s2.Polygon) *geojson.FeatureCollection {
+// polygonFromPath builds a polygon from a single counterclockwise loop.
+func polygonFromPath(points []s2.Point) *s2.Polygon {
+	builder := s2.NewPolygonBuilder(s2.DIRECTED_XOR())
+	builder.AddLoop(s2.NewLoopFromPath(points))
+	poly := new(s2.Polygon)
+	builder.AssemblePolygon(poly, nil)
+	return poly
+}
+
+// unionAll unions polygons pairwise, which is much faster than folding
+// them one at a time when there are many small inputs.
+func unionAll(polygons []*s2.Polygon) *s2.Polygon {
+	switch len(polygons) {
+	case 0:
+		return new(s2.Polygon)
+	case 1:
+		return polygons[0]
+	}
+	mid := len(polygons) / 2
+	var c s2.Polygon
+	c.InitToUnion(unionAll(polygons[:mid]), unionAll(polygons[mid:]))
+	return &c
+}
+
+// checkOperands returns an error unless there are at least min polygons.
+func checkOperands(polygons []*s2.Polygon, min int) error {
+	if len(polygons) == 0 {
+		return ErrNoPolygons
+	}
+	if len(polygons) < min {
+		return ErrTooFewOperands
+	}
+	return nil
+}
+
+type sourceJSON struct {
+	Index      int                    `json:"index"`
+	Id         interface{}            `json:"id,omitempty"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// sourceProperties lists the inputs an output feature was built from.
+func sourceProperties(features []feature) map[string]interface{} {
+	sources := []sourceJSON{}
+	for _, f := range features {
+		sources = append(sources, sourceJSON{
+			Index:      f.index,
+			Id:         f.id,
+			Properties: f.properties,
+		})
+	}
+	return map[string]interface{}{"sources": sources}
+}
+
+// taggedProperties copies the properties of f and records which input it
+// came from.
+func taggedProperties(f feature) map[string]interface{} {
+	props := make(map[string]interface{}, len(f.properties)+2)
+	for k, v := range f.properties {
+		props[k] = v
+	}
+	props["source_index"] = f.index
+	if f.id != nil {
+		props["source_id"] = f.id
+	}
+	return props
+}
+
+func featureCollectionFromS2Polygon(poly *s2.Polygon, id interface{}, properties map[string]interface{}) *geojson.FeatureCollection {
 	feat := geojson.Feature{
-		Typ:      "Feature",
-		Geometry: s2PolygonToGeometry(*poly),
+		Typ:        "Feature",
+		Id:         id,
+		Properties: properties,
+		Geometry:   s2PolygonToGeometry(*poly),
 	}
 	fc := &geojson.FeatureCollection{
 		Typ:      "FeatureCollection",
@@ -69,10 +317,13 @@ func featureCollectionFromS2Polygon(poly *s2.Polygon) *geojson.FeatureCollection
 }
 
 func Union(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
-	polygons, err := geometryToPolygonList(js)
+	polygons, features, err := geometryToPolygonList(js)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkOperands(polygons, 1); err != nil {
+		return nil, err
+	}
 	a := polygons[0]
 	for i := 1; i < len(polygons); i++ {
 		var c s2.Polygon
@@ -80,39 +331,96 @@ func Union(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
 		c.InitToUnion(a, b)
 		a = &c
 	}
-	return featureCollectionFromS2Polygon(a), nil
+	return featureCollectionFromS2Polygon(a, nil, sourceProperties(features)), nil
 }
 
-func Intersection(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
-	polygons, err := geometryToPolygonList(js)
+// IntersectionMode selects what Intersection computes.
+type IntersectionMode int
+
+const (
+	// IntersectAll is the region covered by every input.
+	IntersectAll IntersectionMode = iota
+	// IntersectPairwise is the region where any two inputs overlap.
+	IntersectPairwise
+	// IntersectThreshold is the region covered by at least k inputs.
+	IntersectThreshold
+)
+
+// coverageAtLeast returns the region covered by at least k of polygons.
+func coverageAtLeast(polygons []*s2.Polygon, k int) *s2.Polygon {
+	// levels[j] is the region covered by at least j of the polygons seen
+	// so far; nil means empty.
+	levels := make([]*s2.Polygon, k+1)
+	for _, p := range polygons {
+		for j := k; j >= 1; j-- {
+			add := p
+			if j > 1 {
+				if levels[j-1] == nil {
+					continue
+				}
+				var c s2.Polygon
+				c.InitToIntersection(levels[j-1], p)
+				add = &c
+			}
+			if levels[j] == nil {
+				levels[j] = add
+				continue
+			}
+			var c s2.Polygon
+			c.InitToUnion(levels[j], add)
+			levels[j] = &c
+		}
+	}
+	if levels[k] == nil {
+		return new(s2.Polygon)
+	}
+	return levels[k]
+}
+
+// Intersection intersects the input polygons according to mode. k is
+// only used by IntersectThreshold.
+func Intersection(js geojson.GeoJSON, mode IntersectionMode, k int) (*geojson.FeatureCollection, error) {
+	polygons, features, err := geometryToPolygonList(js)
 	if err != nil {
 		return nil, err
 	}
-	var intersections []*s2.Polygon
-	for i := 0; i < len(polygons); i++ {
-		a := polygons[i]
-		for j := i + 1; j < len(polygons); j++ {
+	if err := checkOperands(polygons, 2); err != nil {
+		return nil, err
+	}
+	var a *s2.Polygon
+	switch mode {
+	case IntersectAll:
+		a = polygons[0]
+		for i := 1; i < len(polygons); i++ {
 			var c s2.Polygon
-			b := polygons[j]
+			b := polygons[i]
 			c.InitToIntersection(a, b)
-			intersections = append(intersections, &c)
+			a = &c
 		}
+	case IntersectPairwise:
+		a = coverageAtLeast(polygons, 2)
+	case IntersectThreshold:
+		if k < 1 {
+			return nil, ErrInvalidThreshold
+		}
+		if k > len(polygons) {
+			return nil, ErrTooFewOperands
+		}
+		a = coverageAtLeast(polygons, k)
+	default:
+		return nil, ErrInvalidMode
 	}
-	a := intersections[0]
-	for i := 1; i < len(intersections); i++ {
-		b := intersections[i]
-		var c s2.Polygon
-		c.InitToUnion(a, b)
-		a = &c
-	}
-	return featureCollectionFromS2Polygon(a), nil
+	return featureCollectionFromS2Polygon(a, nil, sourceProperties(features)), nil
 }
 
 func Difference(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
-	polygons, err := geometryToPolygonList(js)
+	polygons, features, err := geometryToPolygonList(js)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkOperands(polygons, 2); err != nil {
+		return nil, err
+	}
 	a := polygons[0]
 	for i := 1; i < len(polygons); i++ {
 		var c s2.Polygon
@@ -120,15 +428,43 @@ func Difference(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
 		c.InitToDifference(a, b)
 		a = &c
 	}
-	return featureCollectionFromS2Polygon(a), nil
+	// The result is what is left of the first operand.
+	return featureCollectionFromS2Polygon(a, features[0].id, features[0].properties), nil
 }
 
+// SymmetricDifference returns the region covered by an odd number of the
+// input polygons.
 func SymmetricDifference(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
-	polygons, err := geometryToPolygonList(js)
+	polygons, features, err := geometryToPolygonList(js)
 	if err != nil {
 		return nil, err
 	}
-	var features []geojson.Feature
+	if err := checkOperands(polygons, 2); err != nil {
+		return nil, err
+	}
+	a := polygons[0]
+	for i := 1; i < len(polygons); i++ {
+		var ab, ba, c s2.Polygon
+		b := polygons[i]
+		ab.InitToDifference(a, b)
+		ba.InitToDifference(b, a)
+		c.InitToUnion(&ab, &ba)
+		a = &c
+	}
+	return featureCollectionFromS2Polygon(a, nil, sourceProperties(features)), nil
+}
+
+// ExclusiveParts returns, for each input polygon, the part of it not
+// covered by any other input. Empty parts are left out.
+func ExclusiveParts(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
+	polygons, features, err := geometryToPolygonList(js)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkOperands(polygons, 2); err != nil {
+		return nil, err
+	}
+	var output []geojson.Feature
 	for i := 0; i < len(polygons); i++ {
 		a := polygons[i]
 		for j := 0; j < len(polygons); j++ {
@@ -142,15 +478,17 @@ func SymmetricDifference(js geojson.GeoJSON) (*geojson.FeatureCollection, error)
 		}
 		if a.NumLoops() > 0 {
 			feat := geojson.Feature{
-				Typ:      "Feature",
-				Geometry: s2PolygonToGeometry(*a),
+				Typ:        "Feature",
+				Id:         features[i].id,
+				Properties: taggedProperties(features[i]),
+				Geometry:   s2PolygonToGeometry(*a),
 			}
-			features = append(features, feat)
+			output = append(output, feat)
 		}
 	}
 	fc := &geojson.FeatureCollection{
 		Typ:      "FeatureCollection",
-		Features: features,
+		Features: output,
 	}
 	return fc, nil
 }
@@ -0,0 +1,53 @@
+package gos2map
+
+import (
+	"math"
+	"testing"
+
+	"github.com/davidreynolds/gos2/s2"
+)
+
+func rectPolygon(lng0, lat0, lng1, lat1 float64) *s2.Polygon {
+	return polygonFromPath([]s2.Point{
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat0, lng0)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat0, lng1)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat1, lng1)),
+		s2.PointFromLatLng(s2.LatLngFromDegrees(lat1, lng0)),
+	})
+}
+
+func sameArea(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))+1e-15
+}
+
+func TestCoverageAtLeast(t *testing.T) {
+	// Three overlapping strips: a covers lng 0-2, b 1-3 and c 1.5-4.
+	a := rectPolygon(0, 0, 2, 2)
+	b := rectPolygon(1, 0, 3, 2)
+	c := rectPolygon(1.5, 0, 4, 2)
+	// Expected regions are built from the inputs themselves, since edges
+	// are geodesics and the overlaps are not lat/lng rectangles.
+	var ab, bc, ac, abc s2.Polygon
+	ab.InitToIntersection(a, b)
+	bc.InitToIntersection(b, c)
+	ac.InitToIntersection(a, c)
+	abc.InitToIntersection(&ab, c)
+	tests := []struct {
+		name string
+		k    int
+		want float64
+	}{
+		{"k=1 is the union", 1, unionAll([]*s2.Polygon{a, b, c}).Area()},
+		{"k=2 is the pairwise overlap", 2, unionAll([]*s2.Polygon{&ab, &bc, &ac}).Area()},
+		{"k=n is the intersection", 3, abc.Area()},
+		{"k>n is empty", 4, 0},
+	}
+	orders := [][]*s2.Polygon{{a, b, c}, {c, b, a}, {b, c, a}}
+	for _, tt := range tests {
+		for i, polygons := range orders {
+			if got := coverageAtLeast(polygons, tt.k).Area(); !sameArea(got, tt.want) {
+				t.Errorf("%s, order %d: area = %g, want %g", tt.name, i, got, tt.want)
+			}
+		}
+	}
+}
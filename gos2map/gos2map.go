@@ -5,9 +5,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"math"
 	"net/http"
 
 	"strconv"
+	"sync"
 
 	"appengine"
 	"appengine/datastore"
@@ -27,7 +29,20 @@ type GeoJSON struct {
 	JSON string `datastore:",noindex"`
 }
 
-var indexPage = template.Must(template.ParseFiles("templates/index.html"))
+var (
+	indexPage     *template.Template
+	indexPageErr  error
+	indexPageOnce sync.Once
+)
+
+// loadIndexPage parses the page template on first use rather than at
+// init, so the package loads outside the app directory, as under go test.
+func loadIndexPage() (*template.Template, error) {
+	indexPageOnce.Do(func() {
+		indexPage, indexPageErr = template.ParseFiles("templates/index.html")
+	})
+	return indexPage, indexPageErr
+}
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -53,7 +68,12 @@ func mapHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "404 Not Found", http.StatusNotFound)
 		return
 	}
-	if err := indexPage.Execute(w, obj); err != nil {
+	page, err := loadIndexPage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := page.Execute(w, obj); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -89,9 +109,10 @@ type CellIDJSON struct {
 	Level    int       `json:"level"`
 	LL       LatLng    `json:"ll"`
 	Shape    [4]LatLng `json:"shape"`
+	Covering string    `json:"covering,omitempty"`
 }
 
-func cellIdsToJSON(w http.ResponseWriter, ids []s2.CellID) {
+func cellIdsToCovering(ids []s2.CellID) []CellIDJSON {
 	covering := []CellIDJSON{}
 	for _, id := range ids {
 		idJson := CellIDJSON{}
@@ -112,161 +133,422 @@ func cellIdsToJSON(w http.ResponseWriter, ids []s2.CellID) {
 		idJson.Level = cell.Id().Level()
 		covering = append(covering, idJson)
 	}
+	return covering
+}
+
+func cellIdsToJSON(w http.ResponseWriter, ids []s2.CellID) {
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(covering); err != nil {
+	if err := enc.Encode(cellIdsToCovering(ids)); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// coverHandler always reports whether the covering was normalized in the
+// X-Covering-Normalized header, whatever the format, since the default
+// response is a bare list of cells. The JSON envelope used for repair and
+// stats repeats it as "normalized".
 func coverHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Encoding", "gzip")
-	minLevel, err := strconv.Atoi(r.FormValue("min_level"))
-	if err != nil {
-		minLevel = 1
-	}
-	maxLevel, err := strconv.Atoi(r.FormValue("max_level"))
-	if err != nil {
-		maxLevel = s2.MaxCellLevel
-	}
-	maxCells, err := strconv.Atoi(r.FormValue("max_cells"))
-	if err != nil {
-		maxCells = 8
-	}
-	levelMod, err := strconv.Atoi(r.FormValue("level_mod"))
-	if err != nil {
-		levelMod = 1
+	opts, err := parseCoverOptions(r)
+	if hasError(w, err) {
+		return
 	}
-
 	var geojs geojson.GeoJSON
-	err = geojson.Unmarshal([]byte(r.FormValue("geojson")), &geojs)
+	if err := geojson.Unmarshal([]byte(r.FormValue("geojson")), &geojs); err != nil {
+		hasError(w, ErrInvalidRequest)
+		return
+	}
+	result, err := coverGeoJSON(geojs, opts)
 	if hasError(w, err) {
 		return
 	}
-	coverer := s2.NewRegionCoverer()
-	coverer.SetMinLevel(minLevel)
-	coverer.SetMaxLevel(maxLevel)
-	coverer.SetLevelMod(levelMod)
-	coverer.SetMaxCells(maxCells)
-	coverMap := make(map[s2.CellID]struct{})
-	switch geojs := geojs.(type) {
-	case geojson.FeatureCollection:
-		for _, feature := range geojs.Features {
-			geom := feature.Geometry
-			poly, err := geometryToS2Polygon(geom)
-			if hasError(w, err) {
-				return
-			}
-			cover := coverer.Covering(poly)
-			for _, c := range cover {
-				coverMap[c] = struct{}{}
-			}
+	w.Header().Set("X-Covering-Normalized", strconv.FormatBool(opts.normalize))
+	if opts.format == FormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+		if err := writeCoveringCSV(w, result.groups, opts.tagged(), opts.perFeature); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
+		return
 	}
-	covering := make([]s2.CellID, 0, len(coverMap))
-	for k, _ := range coverMap {
-		covering = append(covering, k)
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(result.response(opts)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	cellIdsToJSON(w, covering)
 }
 
 func hasError(w http.ResponseWriter, err error) bool {
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return true
 	}
 	return false
 }
 
-func union(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func decodeGeoJSON(r *http.Request) (geojson.GeoJSON, error) {
 	decoder := json.NewDecoder(r.Body)
 	var m map[string]interface{}
-	err := decoder.Decode(&m)
-	if hasError(w, err) {
-		return
+	if err := decoder.Decode(&m); err != nil {
+		return nil, ErrInvalidRequest
 	}
 	var js geojson.GeoJSON
 	geojson.FromMap(m, &js)
-	collection, err := Union(js)
+	return js, nil
+}
+
+// repairedCollection is an operation result with the repairs made to the
+// input attached as a foreign member.
+type repairedCollection struct {
+	*geojson.FeatureCollection
+	Repairs []Repair `json:"repairs"`
+}
+
+func setOperationHandler(op func(geojson.GeoJSON) (*geojson.FeatureCollection, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		js, err := decodeGeoJSON(r)
+		if hasError(w, err) {
+			return
+		}
+		// The body is the GeoJSON itself, so options come from the query
+		// string rather than the form.
+		repair := r.URL.Query().Get("repair") == "true"
+		var repairs []Repair
+		if repair {
+			js, repairs = RepairGeometry(js)
+		}
+		collection, err := op(js)
+		if hasError(w, err) {
+			return
+		}
+		var resp interface{} = collection
+		if repair {
+			if repairs == nil {
+				repairs = []Repair{}
+			}
+			resp = repairedCollection{collection, repairs}
+		}
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(resp); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func parseIntersectionMode(s string) (IntersectionMode, error) {
+	switch s {
+	case "", "all":
+		return IntersectAll, nil
+	case "pairwise":
+		return IntersectPairwise, nil
+	case "threshold":
+		return IntersectThreshold, nil
+	}
+	return 0, ErrInvalidMode
+}
+
+func intersection(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	mode, err := parseIntersectionMode(query.Get("mode"))
 	if hasError(w, err) {
 		return
 	}
+	// k only matters for threshold mode, where it must be given.
+	k := 0
+	if mode == IntersectThreshold {
+		k, err = strconv.Atoi(query.Get("k"))
+		if err != nil {
+			hasError(w, ErrInvalidThreshold)
+			return
+		}
+	}
+	setOperationHandler(func(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
+		return Intersection(js, mode, k)
+	})(w, r)
+}
+
+func buffer(w http.ResponseWriter, r *http.Request) {
+	meters, err := strconv.ParseFloat(r.URL.Query().Get("meters"), 64)
+	if err != nil {
+		err = ErrInvalidDistance
+	}
+	if hasError(w, err) {
+		return
+	}
+	setOperationHandler(func(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
+		return Buffer(js, meters)
+	})(w, r)
+}
+
+func simplify(w http.ResponseWriter, r *http.Request) {
+	tolerance, err := strconv.ParseFloat(r.URL.Query().Get("tolerance"), 64)
+	if err != nil {
+		err = ErrInvalidDistance
+	}
+	if hasError(w, err) {
+		return
+	}
+	setOperationHandler(func(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
+		return Simplify(js, tolerance)
+	})(w, r)
+}
+
+type validateResponse struct {
+	Valid    bool      `json:"valid"`
+	Problems []Problem `json:"problems"`
+}
+
+func validate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	js, err := decodeGeoJSON(r)
+	if hasError(w, err) {
+		return
+	}
+	problems := Validate(js)
+	if problems == nil {
+		problems = []Problem{}
+	}
+	resp := validateResponse{
+		Valid:    !HasErrors(problems),
+		Problems: problems,
+	}
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(collection); err != nil {
+	if err := enc.Encode(resp); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func intersection(w http.ResponseWriter, r *http.Request) {
+func measureHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	decoder := json.NewDecoder(r.Body)
-	var m map[string]interface{}
-	err := decoder.Decode(&m)
+	js, err := decodeGeoJSON(r)
 	if hasError(w, err) {
 		return
 	}
-	var js geojson.GeoJSON
-	geojson.FromMap(m, &js)
-	collection, err := Intersection(js)
+	result, err := Measure(js)
 	if hasError(w, err) {
 		return
 	}
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(collection); err != nil {
+	if err := enc.Encode(result); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func difference(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// decodeOperands reads the two operands of a binary query. The body is
+// either {"a": GeoJSON, "b": GeoJSON} or {"geojson": GeoJSON, "pair":
+// [i, j]}, which picks two features out of one collection.
+func decodeOperands(r *http.Request) ([]feature, []feature, error) {
 	decoder := json.NewDecoder(r.Body)
 	var m map[string]interface{}
-	err := decoder.Decode(&m)
+	if err := decoder.Decode(&m); err != nil {
+		return nil, nil, ErrInvalidRequest
+	}
+	fromMap := func(key string) ([]feature, bool) {
+		v, ok := m[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		var js geojson.GeoJSON
+		geojson.FromMap(v, &js)
+		return flattenGeoJSON(js), true
+	}
+	if as, ok := fromMap("a"); ok {
+		bs, ok := fromMap("b")
+		if !ok {
+			return nil, nil, ErrInvalidRequest
+		}
+		return as, bs, nil
+	}
+	features, ok := fromMap("geojson")
+	pair, _ := m["pair"].([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, nil, ErrInvalidRequest
+	}
+	var operands [2][]feature
+	for i, v := range pair {
+		index, ok := v.(float64)
+		if !ok {
+			return nil, nil, ErrInvalidRequest
+		}
+		// Check while still a float, since converting an out of range
+		// value to int is undefined.
+		if index != math.Floor(index) || index < 0 || index > math.MaxInt32 {
+			return nil, nil, ErrFeatureIndex
+		}
+		// Features without a geometry are dropped but keep their
+		// index, so look the feature up rather than slicing.
+		for j, f := range features {
+			if f.index == int(index) {
+				operands[i] = features[j : j+1]
+			}
+		}
+		if operands[i] == nil {
+			return nil, nil, &FeatureError{Index: int(index), Err: ErrFeatureIndex}
+		}
+	}
+	return operands[0], operands[1], nil
+}
+
+type relateResponse struct {
+	Relations [][]Relation `json:"relations"`
+}
+
+func relateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	as, bs, err := decodeOperands(r)
 	if hasError(w, err) {
 		return
 	}
-	var js geojson.GeoJSON
-	geojson.FromMap(m, &js)
-	collection, err := Difference(js)
+	relations, err := relateFeatures(as, bs)
 	if hasError(w, err) {
 		return
 	}
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(collection); err != nil {
+	if err := enc.Encode(relateResponse{relations}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func symmetricDifference(w http.ResponseWriter, r *http.Request) {
+func distanceHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	decoder := json.NewDecoder(r.Body)
-	var m map[string]interface{}
-	err := decoder.Decode(&m)
+	as, bs, err := decodeOperands(r)
 	if hasError(w, err) {
 		return
 	}
-	var js geojson.GeoJSON
-	geojson.FromMap(m, &js)
-	collection, err := SymmetricDifference(js)
+	result, err := distanceFeatures(as, bs)
 	if hasError(w, err) {
 		return
 	}
 	enc := json.NewEncoder(w)
-	if err := enc.Encode(collection); err != nil {
+	if err := enc.Encode(result); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+func cellHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := cellIDFromRequest(r, "level")
+	if hasError(w, err) {
+		return
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(NewCellInfo(id)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func cellsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	ids, err := parseCellList(r.FormValue("cells"))
+	if hasError(w, err) {
+		return
+	}
+	cellIdsToJSON(w, ids)
+}
+
+// cellNeighborsHandler and the other traversal handlers take the cell the
+// same way as /a/cell, except that a lat/lng lookup reads its level from
+// cell_level, since level is the level traversed to.
+func cellNeighborsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := cellIDFromRequest(r, "cell_level")
+	if hasError(w, err) {
+		return
+	}
+	kind, err := parseNeighborType(r.FormValue("type"))
+	if hasError(w, err) {
+		return
+	}
+	k, err := intParam(r, "k", 0)
+	if hasError(w, err) {
+		return
+	}
+	if k > 0 {
+		rings, err := kRing(id, kind, k)
+		if hasError(w, err) {
+			return
+		}
+		out := make([][]CellIDJSON, len(rings))
+		for i, ring := range rings {
+			out[i] = cellIdsToCovering(ring)
+		}
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(out); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	def := id.Level()
+	if kind == NeighborsVertex {
+		def = id.Level() - 1
+	}
+	level, err := intParam(r, "level", def)
+	if hasError(w, err) {
+		return
+	}
+	ids, err := cellNeighbors(id, kind, level)
+	if hasError(w, err) {
+		return
+	}
+	cellIdsToJSON(w, ids)
+}
+
+func cellChildrenHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := cellIDFromRequest(r, "cell_level")
+	if hasError(w, err) {
+		return
+	}
+	level, err := intParam(r, "level", id.Level()+1)
+	if hasError(w, err) {
+		return
+	}
+	ids, err := cellChildrenAtLevel(id, level)
+	if hasError(w, err) {
+		return
+	}
+	cellIdsToJSON(w, ids)
+}
+
+func cellParentHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, err := cellIDFromRequest(r, "cell_level")
+	if hasError(w, err) {
+		return
+	}
+	level, err := intParam(r, "level", id.Level()-1)
+	if hasError(w, err) {
+		return
+	}
+	if level < 0 || level > id.Level() {
+		hasError(w, ErrInvalidLevel)
+		return
+	}
+	cellIdsToJSON(w, []s2.CellID{id.Parent(level)})
+}
+
 func init() {
 	r := mux.NewRouter()
 	r.HandleFunc("/", indexHandler)
 	r.HandleFunc("/{name:[a-zA-Z]+}", mapHandler).Methods("GET")
 	r.HandleFunc("/{name:[a-zA-Z]+}", updateEditor).Methods("POST")
 	r.HandleFunc("/a/s2cover", coverHandler)
-	r.HandleFunc("/a/union", union)
+	r.HandleFunc("/a/cell", cellHandler)
+	r.HandleFunc("/a/cells", cellsHandler)
+	r.HandleFunc("/a/cell/neighbors", cellNeighborsHandler)
+	r.HandleFunc("/a/cell/children", cellChildrenHandler)
+	r.HandleFunc("/a/cell/parent", cellParentHandler)
+	r.HandleFunc("/a/union", setOperationHandler(Union))
 	r.HandleFunc("/a/intersection", intersection)
-	r.HandleFunc("/a/difference", difference)
-	r.HandleFunc("/a/symmetric_difference", symmetricDifference)
+	r.HandleFunc("/a/difference", setOperationHandler(Difference))
+	r.HandleFunc("/a/symmetric_difference", setOperationHandler(SymmetricDifference))
+	r.HandleFunc("/a/exclusive_parts", setOperationHandler(ExclusiveParts))
+	r.HandleFunc("/a/convex_hull", setOperationHandler(ConvexHull))
+	r.HandleFunc("/a/buffer", buffer)
+	r.HandleFunc("/a/simplify", simplify)
+	r.HandleFunc("/a/validate", validate)
+	r.HandleFunc("/a/measure", measureHandler)
+	r.HandleFunc("/a/relate", relateHandler)
+	r.HandleFunc("/a/distance", distanceHandler)
 	http.Handle("/", r)
 }
@@ -0,0 +1,141 @@
+package gos2map
+
+import (
+	"math"
+	"sort"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/r3"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// geometryCoordinates returns every vertex of geom.
+func geometryCoordinates(geom geojson.GeoJSON) []geojson.Coordinate {
+	var coords []geojson.Coordinate
+	switch geom := geom.(type) {
+	case geojson.Point:
+		coords = append(coords, geom.Coordinates)
+	case geojson.MultiPoint:
+		coords = append(coords, geom.Coordinates...)
+	case geojson.LineString:
+		coords = append(coords, geom.Coordinates...)
+	case geojson.MultiLineString:
+		for _, line := range geom.Coordinates {
+			coords = append(coords, line...)
+		}
+	case geojson.Polygon:
+		for _, ring := range geom.Coordinates {
+			coords = append(coords, ring...)
+		}
+	case geojson.MultiPolygon:
+		for _, polygon := range geom.Coordinates {
+			for _, ring := range polygon {
+				coords = append(coords, ring...)
+			}
+		}
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			coords = append(coords, geometryCoordinates(g)...)
+		}
+	}
+	return coords
+}
+
+// projected is a vertex in the gnomonic projection used by ConvexHull.
+type projected struct {
+	x, y  float64
+	coord geojson.Coordinate
+}
+
+type byXY []projected
+
+func (s byXY) Len() int      { return len(s) }
+func (s byXY) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byXY) Less(i, j int) bool {
+	if s[i].x != s[j].x {
+		return s[i].x < s[j].x
+	}
+	return s[i].y < s[j].y
+}
+
+func turn(o, a, b projected) float64 {
+	return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+}
+
+// ConvexHull returns the smallest convex polygon containing every point,
+// line and polygon in js. The gnomonic projection maps great circles to
+// straight lines, so the planar hull of the projected vertices is the
+// spherical hull, as long as everything fits in one hemisphere.
+func ConvexHull(js geojson.GeoJSON) (*geojson.FeatureCollection, error) {
+	features := flattenGeoJSON(js)
+	var coords []geojson.Coordinate
+	for _, f := range features {
+		coords = append(coords, geometryCoordinates(f.geometry)...)
+	}
+	if len(coords) == 0 {
+		return nil, ErrNoPolygons
+	}
+	var sum r3.Vector
+	points := make([]s2.Point, len(coords))
+	for i, c := range coords {
+		points[i] = coordinateToS2Point(c)
+		sum = sum.Add(points[i].Vector)
+	}
+	if sum.Norm() < 1e-12 {
+		return nil, ErrNotInHemisphere
+	}
+	center := sum.Normalize()
+	axis := r3.Vector{Z: 1}
+	if math.Abs(center.Z) > 0.9 {
+		axis = r3.Vector{X: 1}
+	}
+	u := center.Cross(axis).Normalize()
+	v := center.Cross(u)
+	var plane []projected
+	for i, p := range points {
+		d := p.Dot(center)
+		if d <= 1e-9 {
+			return nil, ErrNotInHemisphere
+		}
+		plane = append(plane, projected{p.Dot(u) / d, p.Dot(v) / d, coords[i]})
+	}
+	sort.Sort(byXY(plane))
+
+	// Andrew's monotone chain, counterclockwise.
+	hull := make([]projected, 0, 2*len(plane))
+	for _, p := range plane {
+		for len(hull) >= 2 && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(plane) - 2; i >= 0; i-- {
+		p := plane[i]
+		for len(hull) >= lower && turn(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	// The last vertex repeats the first, which closes the ring.
+	if len(hull) < 4 {
+		return nil, ErrInvalidRing
+	}
+	ring := make([]geojson.Coordinate, len(hull))
+	for i, p := range hull {
+		ring[i] = p.coord
+	}
+	feat := geojson.Feature{
+		Typ:        "Feature",
+		Properties: sourceProperties(features),
+		Geometry: &geojson.Polygon{
+			Typ:         "Polygon",
+			Coordinates: [][]geojson.Coordinate{ring},
+		},
+	}
+	fc := &geojson.FeatureCollection{
+		Typ:      "FeatureCollection",
+		Features: []geojson.Feature{feat},
+	}
+	return fc, nil
+}
@@ -0,0 +1,140 @@
+package gos2map
+
+import (
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/r3"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// Bounds is a latitude/longitude rectangle. Lo.Lng is greater than
+// Hi.Lng when the rectangle crosses the antimeridian.
+type Bounds struct {
+	Lo LatLng `json:"lo"`
+	Hi LatLng `json:"hi"`
+}
+
+func boundsFromRect(rect s2.LatLngRect) *Bounds {
+	if rect.IsEmpty() {
+		return nil
+	}
+	lo, hi := rect.Lo(), rect.Hi()
+	return &Bounds{
+		Lo: LatLng{Lat: lo.Lat.Degrees(), Lng: lo.Lng.Degrees()},
+		Hi: LatLng{Lat: hi.Lat.Degrees(), Lng: hi.Lng.Degrees()},
+	}
+}
+
+// Measurement holds the spherical measurements of one feature. Area and
+// perimeter come from polygonal parts and length from lines; the
+// centroid is taken from the highest dimension present.
+type Measurement struct {
+	Feature   int         `json:"feature"`
+	Id        interface{} `json:"id,omitempty"`
+	Area      float64     `json:"area_m2"`
+	AreaKm2   float64     `json:"area_km2"`
+	Perimeter float64     `json:"perimeter_m"`
+	Length    float64     `json:"length_m"`
+	Centroid  *LatLng     `json:"centroid,omitempty"`
+	Bounds    *Bounds     `json:"bounds,omitempty"`
+	Loops     int         `json:"loops"`
+	Vertices  int         `json:"vertices"`
+}
+
+// MeasureResult holds a measurement per feature and one for the whole
+// input, where overlapping polygons are only counted once. Total.Feature
+// is -1.
+type MeasureResult struct {
+	Features []Measurement `json:"features"`
+	Total    Measurement   `json:"total"`
+}
+
+func pathLength(points []s2.Point, closed bool) float64 {
+	length := 0.0
+	for i := 1; i < len(points); i++ {
+		length += float64(points[i-1].Angle(points[i].Vector))
+	}
+	if closed && len(points) > 1 {
+		length += float64(points[len(points)-1].Angle(points[0].Vector))
+	}
+	return length
+}
+
+func measure(poly *s2.Polygon, lines [][]s2.Point, points []s2.Point) Measurement {
+	var m Measurement
+	var centroid r3.Vector
+	// Merge bounds as a LatLngRect so rectangles crossing the
+	// antimeridian stay intact.
+	rect := s2.EmptyLatLngRect()
+	if poly != nil && poly.NumLoops() > 0 {
+		m.Area = poly.Area() * earthRadiusMeters * earthRadiusMeters
+		m.Loops = poly.NumLoops()
+		for i := 0; i < poly.NumLoops(); i++ {
+			loop := loopPoints(poly.Loop(i))
+			m.Perimeter += pathLength(loop, true) * earthRadiusMeters
+			m.Vertices += len(loop)
+		}
+		rect = rect.Union(poly.RectBound())
+		centroid = poly.Centroid().Vector
+	}
+	var lineCentroid, pointCentroid r3.Vector
+	for _, line := range lines {
+		m.Length += pathLength(line, false) * earthRadiusMeters
+		m.Vertices += len(line)
+		for i := 1; i < len(line); i++ {
+			// Weight each edge midpoint by the edge length.
+			mid := line[i-1].Add(line[i].Vector)
+			lineCentroid = lineCentroid.Add(mid.Normalize().Mul(float64(line[i-1].Angle(line[i].Vector))))
+		}
+		for _, p := range line {
+			rect = rect.AddPoint(s2.LatLngFromPoint(p))
+		}
+	}
+	for _, p := range points {
+		pointCentroid = pointCentroid.Add(p.Vector)
+		rect = rect.AddPoint(s2.LatLngFromPoint(p))
+	}
+	m.Bounds = boundsFromRect(rect)
+	m.Vertices += len(points)
+	m.AreaKm2 = m.Area / 1e6
+	for _, c := range []r3.Vector{centroid, lineCentroid, pointCentroid} {
+		if c.Norm() > 0 {
+			ll := latLngFromPoint(s2.Point{Vector: c.Normalize()})
+			m.Centroid = &ll
+			break
+		}
+	}
+	return m
+}
+
+// Measure computes the area, perimeter, length, centroid, bounds and
+// loop and vertex counts of every feature in js, on the sphere.
+func Measure(js geojson.GeoJSON) (*MeasureResult, error) {
+	features := flattenGeoJSON(js)
+	if len(features) == 0 {
+		return nil, ErrNoPolygons
+	}
+	result := &MeasureResult{Features: []Measurement{}}
+	var polygons []*s2.Polygon
+	var lines [][]s2.Point
+	var points []s2.Point
+	for _, f := range features {
+		poly, err := geometryToS2Polygon(f.geometry)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		fl := lineStringPoints(f.geometry)
+		fp := geometryToS2Points(f.geometry)
+		m := measure(poly, fl, fp)
+		m.Feature = f.index
+		m.Id = f.id
+		result.Features = append(result.Features, m)
+		if poly != nil {
+			polygons = append(polygons, poly)
+		}
+		lines = append(lines, fl...)
+		points = append(points, fp...)
+	}
+	result.Total = measure(unionAll(polygons), lines, points)
+	result.Total.Feature = -1
+	return result, nil
+}
@@ -0,0 +1,148 @@
+package gos2map
+
+import (
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+// approxTolerance is the angle in radians within which points, and
+// polygon boundaries, are considered approximately equal.
+const approxTolerance = 1e-7
+
+// Relation holds the spatial predicates between feature A of the first
+// input and feature B of the second. Contains and Within are from A's
+// point of view.
+type Relation struct {
+	A            int  `json:"a"`
+	B            int  `json:"b"`
+	Contains     bool `json:"contains"`
+	Intersects   bool `json:"intersects"`
+	Within       bool `json:"within"`
+	Disjoint     bool `json:"disjoint"`
+	ApproxEquals bool `json:"approx_equals"`
+}
+
+// shape is a feature reduced to either a polygon or a set of points.
+type shape struct {
+	poly   *s2.Polygon
+	points []s2.Point
+}
+
+func featureShape(f feature) (shape, error) {
+	switch f.geometry.(type) {
+	case geojson.Point, geojson.MultiPoint:
+		return shape{points: geometryToS2Points(f.geometry)}, nil
+	}
+	poly, err := geometryToS2Polygon(f.geometry)
+	if err != nil {
+		return shape{}, err
+	}
+	if poly == nil {
+		return shape{}, ErrUnsupportedGeometry
+	}
+	return shape{poly: poly}, nil
+}
+
+func containsPoint(points []s2.Point, x s2.Point) bool {
+	for _, p := range points {
+		if float64(p.Angle(x.Vector)) <= approxTolerance {
+			return true
+		}
+	}
+	return false
+}
+
+// polygonsApproxEqual reports whether the symmetric difference of a and b
+// is no larger than a band of width approxTolerance along their
+// boundaries.
+func polygonsApproxEqual(a, b *s2.Polygon) bool {
+	var ab, ba s2.Polygon
+	ab.InitToDifference(a, b)
+	ba.InitToDifference(b, a)
+	perimeter := 0.0
+	for _, poly := range []*s2.Polygon{a, b} {
+		for i := 0; i < poly.NumLoops(); i++ {
+			perimeter += pathLength(loopPoints(poly.Loop(i)), true)
+		}
+	}
+	return ab.Area()+ba.Area() <= perimeter*approxTolerance
+}
+
+func relate(a, b shape) Relation {
+	var r Relation
+	switch {
+	case a.poly != nil && b.poly != nil:
+		r.Contains = a.poly.Contains(b.poly)
+		r.Within = b.poly.Contains(a.poly)
+		r.Intersects = a.poly.Intersects(b.poly)
+		r.ApproxEquals = (r.Contains && r.Within) || polygonsApproxEqual(a.poly, b.poly)
+	case a.poly != nil:
+		r.Contains = len(b.points) > 0
+		for _, p := range b.points {
+			in := a.poly.ContainsPoint(p)
+			r.Contains = r.Contains && in
+			r.Intersects = r.Intersects || in
+		}
+	case b.poly != nil:
+		r = relate(b, a)
+		r.Contains, r.Within = false, r.Contains
+	default:
+		r.Contains = len(b.points) > 0
+		for _, p := range b.points {
+			in := containsPoint(a.points, p)
+			r.Contains = r.Contains && in
+			r.Intersects = r.Intersects || in
+		}
+		r.Within = len(a.points) > 0
+		for _, p := range a.points {
+			r.Within = r.Within && containsPoint(b.points, p)
+		}
+		r.ApproxEquals = r.Contains && r.Within
+	}
+	r.Disjoint = !r.Intersects
+	return r
+}
+
+func featureShapes(features []feature) ([]shape, error) {
+	shapes := make([]shape, len(features))
+	for i, f := range features {
+		s, err := featureShape(f)
+		if err != nil {
+			return nil, &FeatureError{Index: f.index, Err: err}
+		}
+		shapes[i] = s
+	}
+	return shapes, nil
+}
+
+// relateFeatures returns the relation of every feature in as to every
+// feature in bs, indexed [a][b].
+func relateFeatures(as, bs []feature) ([][]Relation, error) {
+	if len(as) == 0 || len(bs) == 0 {
+		return nil, ErrNoPolygons
+	}
+	sa, err := featureShapes(as)
+	if err != nil {
+		return nil, err
+	}
+	sb, err := featureShapes(bs)
+	if err != nil {
+		return nil, err
+	}
+	matrix := make([][]Relation, len(as))
+	for i := range as {
+		matrix[i] = make([]Relation, len(bs))
+		for j := range bs {
+			r := relate(sa[i], sb[j])
+			r.A, r.B = as[i].index, bs[j].index
+			matrix[i][j] = r
+		}
+	}
+	return matrix, nil
+}
+
+// Relate returns the spatial predicates between every feature of a and
+// every feature of b. Only polygons and points are supported.
+func Relate(a, b geojson.GeoJSON) ([][]Relation, error) {
+	return relateFeatures(flattenGeoJSON(a), flattenGeoJSON(b))
+}
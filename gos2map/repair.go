@@ -0,0 +1,205 @@
+package gos2map
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+const (
+	RepairClosedRing        = "closed_ring"
+	RepairRemovedDuplicates = "removed_duplicate_vertices"
+	RepairReversedRing      = "reversed_ring"
+	RepairSplitRing         = "split_self_intersection"
+	RepairDroppedRing       = "dropped_ring"
+)
+
+// Repair describes one change made by RepairGeometry. Feature, Part and
+// Ring locate the ring the same way Problem does.
+type Repair struct {
+	Feature int    `json:"feature"`
+	Part    int    `json:"part"`
+	Ring    int    `json:"ring"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+type repairer struct {
+	repairs []Repair
+	feature int
+	part    int
+	ring    int
+}
+
+func (rp *repairer) add(kind, msg string) {
+	rp.repairs = append(rp.repairs, Repair{
+		Feature: rp.feature,
+		Part:    rp.part,
+		Ring:    rp.ring,
+		Kind:    kind,
+		Message: msg,
+	})
+}
+
+func reverseRing(ring []geojson.Coordinate) {
+	for i, j := 0, len(ring)-1; i < j; i, j = i+1, j-1 {
+		ring[i], ring[j] = ring[j], ring[i]
+	}
+}
+
+// repairRing closes ring, drops duplicate vertices and orients it
+// counterclockwise for shells and clockwise for holes. It returns the
+// cleaned, still open ring, or nil if too few vertices are left.
+func (rp *repairer) repairRing(ring []geojson.Coordinate, hole bool) []geojson.Coordinate {
+	if len(ring) > 0 && !sameCoordinate(ring[0], ring[len(ring)-1]) {
+		rp.add(RepairClosedRing, "closed the ring")
+	}
+	clean := cleanRing(ring)
+	// A closed ring legitimately repeats its first vertex once.
+	expected := len(clean) + 1
+	if len(ring) > 0 && !sameCoordinate(ring[0], ring[len(ring)-1]) {
+		expected = len(clean)
+	}
+	if n := len(ring) - expected; n > 0 {
+		rp.add(RepairRemovedDuplicates, fmt.Sprintf("removed %d duplicate vertices", n))
+	}
+	if len(clean) < 3 {
+		rp.add(RepairDroppedRing, fmt.Sprintf("dropped ring with %d distinct vertices", len(clean)))
+		return nil
+	}
+	if ccw := signedArea(clean) > 0; ccw == hole {
+		reverseRing(clean)
+		rp.add(RepairReversedRing, "reversed the ring orientation")
+	}
+	return clean
+}
+
+type byDistance struct {
+	origin s2.Point
+	points []s2.Point
+}
+
+func (s byDistance) Len() int      { return len(s.points) }
+func (s byDistance) Swap(i, j int) { s.points[i], s.points[j] = s.points[j], s.points[i] }
+func (s byDistance) Less(i, j int) bool {
+	return s.origin.Angle(s.points[i].Vector) < s.origin.Angle(s.points[j].Vector)
+}
+
+// addSplitRing adds the edges of ring to builder with a vertex inserted
+// at every self-intersection, so the builder can untangle it into simple
+// loops.
+func addSplitRing(builder *s2.PolygonBuilder, ring []geojson.Coordinate, crossings []crossing) {
+	n := len(ring)
+	splits := make([][]s2.Point, n)
+	for _, x := range crossings {
+		splits[x.i] = append(splits[x.i], x.point)
+		splits[x.j] = append(splits[x.j], x.point)
+	}
+	for i := 0; i < n; i++ {
+		a := coordinateToS2Point(ring[i])
+		b := coordinateToS2Point(ring[(i+1)%n])
+		sort.Sort(byDistance{a, splits[i]})
+		for _, p := range splits[i] {
+			builder.AddEdge(a, p)
+			a = p
+		}
+		builder.AddEdge(a, b)
+	}
+}
+
+// repairPolygon returns the repaired rings of a polygon. Rings are
+// returned closed; an empty result means nothing usable was left.
+func (rp *repairer) repairPolygon(rings [][]geojson.Coordinate) [][]geojson.Coordinate {
+	var clean [][]geojson.Coordinate
+	var crossings [][]crossing
+	split := false
+	for i, ring := range rings {
+		rp.ring = i
+		c := rp.repairRing(ring, i > 0)
+		if c == nil {
+			if i == 0 {
+				// Holes mean nothing without their shell.
+				return nil
+			}
+			continue
+		}
+		x := selfIntersections(c)
+		if len(x) > 0 {
+			rp.add(RepairSplitRing, fmt.Sprintf("split the ring at %d self-intersections", len(x)))
+			split = true
+		}
+		clean = append(clean, c)
+		crossings = append(crossings, x)
+	}
+	if split {
+		builder := s2.NewPolygonBuilder(s2.UNDIRECTED_XOR())
+		for i, c := range clean {
+			addSplitRing(builder, c, crossings[i])
+		}
+		poly := new(s2.Polygon)
+		builder.AssemblePolygon(poly, nil)
+		return s2PolygonToGeometry(*poly).Coordinates
+	}
+	for i, c := range clean {
+		clean[i] = append(c, c[0])
+	}
+	return clean
+}
+
+func (rp *repairer) repairGeometry(geom geojson.GeoJSON) geojson.GeoJSON {
+	rp.part, rp.ring = 0, -1
+	switch geom := geom.(type) {
+	case geojson.Polygon:
+		geom.Coordinates = rp.repairPolygon(geom.Coordinates)
+		if geom.Coordinates == nil {
+			geom.Coordinates = [][]geojson.Coordinate{}
+		}
+		return geom
+	case geojson.MultiPolygon:
+		polygons := [][][]geojson.Coordinate{}
+		for i, polygon := range geom.Coordinates {
+			rp.part = i
+			if rings := rp.repairPolygon(polygon); len(rings) > 0 {
+				polygons = append(polygons, rings)
+			}
+		}
+		geom.Coordinates = polygons
+		return geom
+	case geojson.GeometryCollection:
+		var geometries []geojson.GeoJSON
+		for _, g := range geom.Geometries {
+			geometries = append(geometries, rp.repairGeometry(g))
+		}
+		geom.Geometries = geometries
+		return geom
+	}
+	return geom
+}
+
+// RepairGeometry fixes the ring problems reported by Validate that can
+// be fixed mechanically. It returns the input as a flattened
+// FeatureCollection, keeping features without a geometry so positions
+// don't shift, along with the list of repairs applied.
+func RepairGeometry(js geojson.GeoJSON) (geojson.GeoJSON, []Repair) {
+	rp := new(repairer)
+	fc := geojson.FeatureCollection{
+		Typ:      "FeatureCollection",
+		Features: []geojson.Feature{},
+	}
+	for _, f := range allFeatures(js) {
+		rp.feature = f.index
+		geom := f.geometry
+		if geom != nil {
+			geom = rp.repairGeometry(geom)
+		}
+		fc.Features = append(fc.Features, geojson.Feature{
+			Typ:        "Feature",
+			Id:         f.id,
+			Properties: f.properties,
+			Geometry:   geom,
+		})
+	}
+	return fc, rp.repairs
+}
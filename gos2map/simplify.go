@@ -0,0 +1,264 @@
+package gos2map
+
+import (
+	"math"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+type coordinateKey [2]float64
+
+func keyOf(v geojson.Coordinate) coordinateKey {
+	return coordinateKey{v[0], v[1]}
+}
+
+func lessKey(a, b coordinateKey) bool {
+	return a[0] < b[0] || a[0] == b[0] && a[1] < b[1]
+}
+
+// simplifier runs Douglas-Peucker on the sphere over every path in the
+// input. Vertices where paths meet or branch are never removed, so
+// boundaries shared by adjacent features are simplified the same way on
+// both sides and stay shared.
+type simplifier struct {
+	tolerance float64
+	neighbors map[coordinateKey]map[coordinateKey]bool
+}
+
+func (s *simplifier) link(a, b geojson.Coordinate) {
+	ka, kb := keyOf(a), keyOf(b)
+	if ka == kb {
+		return
+	}
+	for _, pair := range [][2]coordinateKey{{ka, kb}, {kb, ka}} {
+		if s.neighbors[pair[0]] == nil {
+			s.neighbors[pair[0]] = make(map[coordinateKey]bool)
+		}
+		s.neighbors[pair[0]][pair[1]] = true
+	}
+}
+
+func (s *simplifier) addPath(path []geojson.Coordinate, closed bool) {
+	for i := 1; i < len(path); i++ {
+		s.link(path[i-1], path[i])
+	}
+	if closed && len(path) > 1 {
+		s.link(path[len(path)-1], path[0])
+	}
+}
+
+// fixed reports whether v is a node of the graph formed by all paths,
+// i.e. an endpoint or a point where paths branch.
+func (s *simplifier) fixed(v geojson.Coordinate) bool {
+	return len(s.neighbors[keyOf(v)]) != 2
+}
+
+// douglasPeucker marks the points between i and j that must be kept to
+// stay within tolerance of the original path.
+func (s *simplifier) douglasPeucker(points []s2.Point, i, j int, keep []bool) {
+	if j-i < 2 {
+		return
+	}
+	worst, index := -1.0, -1
+	for k := i + 1; k < j; k++ {
+		if d := distanceToEdge(points[k], points[i], points[j]); d > worst {
+			worst, index = d, k
+		}
+	}
+	if worst <= s.tolerance {
+		return
+	}
+	keep[index] = true
+	s.douglasPeucker(points, i, index, keep)
+	s.douglasPeucker(points, index, j, keep)
+}
+
+// simplifyPath returns path with unneeded vertices removed. keep must
+// already mark the vertices that may not be removed, including both
+// ends.
+func (s *simplifier) simplifyPath(path []geojson.Coordinate, keep []bool) []geojson.Coordinate {
+	points := make([]s2.Point, len(path))
+	for i, v := range path {
+		points[i] = coordinateToS2Point(v)
+	}
+	start := 0
+	for i := 1; i < len(path); i++ {
+		if keep[i] {
+			s.douglasPeucker(points, start, i, keep)
+			start = i
+		}
+	}
+	var out []geojson.Coordinate
+	for i, v := range path {
+		if keep[i] {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (s *simplifier) simplifyLine(line []geojson.Coordinate) []geojson.Coordinate {
+	if len(line) < 3 {
+		return line
+	}
+	keep := make([]bool, len(line))
+	for i, v := range line {
+		keep[i] = i == 0 || i == len(line)-1 || s.fixed(v)
+	}
+	return s.simplifyPath(line, keep)
+}
+
+func (s *simplifier) simplifyRing(ring []geojson.Coordinate) []geojson.Coordinate {
+	clean := cleanRing(ring)
+	if len(clean) < 4 {
+		return ring
+	}
+	// Start the ring at a fixed vertex. A ring that touches nothing is
+	// anchored at its smallest vertex and the vertex farthest from it,
+	// chosen by coordinates alone so that an island and the hole it
+	// fills, which may start at different vertices, anchor the same way.
+	first := -1
+	for i, v := range clean {
+		if s.fixed(v) {
+			first = i
+			break
+		}
+	}
+	anchored := first < 0
+	if anchored {
+		first = 0
+		for i, v := range clean {
+			if lessKey(keyOf(v), keyOf(clean[first])) {
+				first = i
+			}
+		}
+	}
+	path := append(append([]geojson.Coordinate{}, clean[first:]...), clean[:first]...)
+	path = append(path, path[0])
+	keep := make([]bool, len(path))
+	for i, v := range path {
+		keep[i] = i == 0 || i == len(path)-1 || s.fixed(v)
+	}
+	if anchored {
+		origin := coordinateToS2Point(path[0])
+		far, farthest := 0, -1.0
+		for i, v := range path {
+			d := float64(origin.Angle(coordinateToS2Point(v).Vector))
+			if d > farthest || d == farthest && lessKey(keyOf(v), keyOf(path[far])) {
+				far, farthest = i, d
+			}
+		}
+		keep[far] = true
+	}
+	out := s.simplifyPath(path, keep)
+	// Never collapse a ring below a triangle.
+	if len(out) < 4 {
+		return ring
+	}
+	return out
+}
+
+func (s *simplifier) collect(geom geojson.GeoJSON) {
+	switch geom := geom.(type) {
+	case geojson.LineString:
+		s.addPath(geom.Coordinates, false)
+	case geojson.MultiLineString:
+		for _, line := range geom.Coordinates {
+			s.addPath(line, false)
+		}
+	case geojson.Polygon:
+		for _, ring := range geom.Coordinates {
+			s.addPath(cleanRing(ring), true)
+		}
+	case geojson.MultiPolygon:
+		for _, polygon := range geom.Coordinates {
+			for _, ring := range polygon {
+				s.addPath(cleanRing(ring), true)
+			}
+		}
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			s.collect(g)
+		}
+	}
+}
+
+func (s *simplifier) simplifyRings(rings [][]geojson.Coordinate) [][]geojson.Coordinate {
+	out := make([][]geojson.Coordinate, len(rings))
+	for i, ring := range rings {
+		out[i] = s.simplifyRing(ring)
+	}
+	return out
+}
+
+func (s *simplifier) simplify(geom geojson.GeoJSON) geojson.GeoJSON {
+	switch geom := geom.(type) {
+	case geojson.LineString:
+		geom.Coordinates = s.simplifyLine(geom.Coordinates)
+		return geom
+	case geojson.MultiLineString:
+		lines := make([][]geojson.Coordinate, len(geom.Coordinates))
+		for i, line := range geom.Coordinates {
+			lines[i] = s.simplifyLine(line)
+		}
+		geom.Coordinates = lines
+		return geom
+	case geojson.Polygon:
+		geom.Coordinates = s.simplifyRings(geom.Coordinates)
+		return geom
+	case geojson.MultiPolygon:
+		polygons := make([][][]geojson.Coordinate, len(geom.Coordinates))
+		for i, polygon := range geom.Coordinates {
+			polygons[i] = s.simplifyRings(polygon)
+		}
+		geom.Coordinates = polygons
+		return geom
+	case geojson.GeometryCollection:
+		geometries := make([]geojson.GeoJSON, len(geom.Geometries))
+		for i, g := range geom.Geometries {
+			geometries[i] = s.simplify(g)
+		}
+		geom.Geometries = geometries
+		return geom
+	}
+	return geom
+}
+
+// Simplify removes vertices from every line and ring in js as long as
+// the result stays within toleranceMeters of the original. Boundaries
+// shared between features keep their shared vertices.
+func Simplify(js geojson.GeoJSON, toleranceMeters float64) (*geojson.FeatureCollection, error) {
+	if toleranceMeters < 0 || math.IsNaN(toleranceMeters) || math.IsInf(toleranceMeters, 0) {
+		return nil, ErrInvalidDistance
+	}
+	s := &simplifier{
+		tolerance: metersToAngle(toleranceMeters),
+		neighbors: make(map[coordinateKey]map[coordinateKey]bool),
+	}
+	// Features without a geometry pass through so positions don't shift.
+	features := allFeatures(js)
+	for _, f := range features {
+		if f.geometry != nil {
+			s.collect(f.geometry)
+		}
+	}
+	output := []geojson.Feature{}
+	for _, f := range features {
+		geom := f.geometry
+		if geom != nil {
+			geom = s.simplify(geom)
+		}
+		output = append(output, geojson.Feature{
+			Typ:        "Feature",
+			Id:         f.id,
+			Properties: f.properties,
+			Geometry:   geom,
+		})
+	}
+	fc := &geojson.FeatureCollection{
+		Typ:      "FeatureCollection",
+		Features: output,
+	}
+	return fc, nil
+}
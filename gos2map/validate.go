@@ -0,0 +1,239 @@
+package gos2map
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/davidreynolds/geojson"
+	"github.com/davidreynolds/gos2/s2"
+)
+
+const (
+	ProblemUnclosedRing     = "unclosed_ring"
+	ProblemDuplicateVertex  = "duplicate_vertex"
+	ProblemTooFewVertices   = "too_few_vertices"
+	ProblemOutOfBounds      = "out_of_bounds"
+	ProblemSelfIntersection = "self_intersection"
+	ProblemOrientation      = "orientation"
+	ProblemAntimeridian     = "antimeridian_crossing"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem describes one defect found by Validate. Part is the member
+// index within a multi-geometry, Ring is the ring index within a polygon
+// (-1 for points and lines) and Vertex is -1 when the problem concerns
+// the ring as a whole.
+type Problem struct {
+	Feature  int     `json:"feature"`
+	Part     int     `json:"part"`
+	Ring     int     `json:"ring"`
+	Vertex   int     `json:"vertex"`
+	Kind     string  `json:"kind"`
+	Severity string  `json:"severity"`
+	Message  string  `json:"message"`
+	Location *LatLng `json:"location,omitempty"`
+}
+
+func coordinateLatLng(v geojson.Coordinate) *LatLng {
+	return &LatLng{Lat: v[1], Lng: v[0]}
+}
+
+// cleanRing returns the distinct vertices of ring in order, without
+// consecutive duplicates and without the closing vertex.
+func cleanRing(ring []geojson.Coordinate) []geojson.Coordinate {
+	var out []geojson.Coordinate
+	for _, v := range ring {
+		if len(out) == 0 || !sameCoordinate(v, out[len(out)-1]) {
+			out = append(out, v)
+		}
+	}
+	for len(out) > 1 && sameCoordinate(out[0], out[len(out)-1]) {
+		out = out[:len(out)-1]
+	}
+	return out
+}
+
+// signedArea returns the planar shoelace area of ring in square degrees,
+// positive for counterclockwise rings. Longitudes are unwrapped first so
+// rings crossing the antimeridian keep their orientation.
+func signedArea(ring []geojson.Coordinate) float64 {
+	if len(ring) < 3 {
+		return 0
+	}
+	xs := make([]float64, len(ring))
+	xs[0] = ring[0][0]
+	for i := 1; i < len(ring); i++ {
+		d := ring[i][0] - ring[i-1][0]
+		if d > 180 {
+			d -= 360
+		} else if d < -180 {
+			d += 360
+		}
+		xs[i] = xs[i-1] + d
+	}
+	area := 0.0
+	for i := range ring {
+		j := (i + 1) % len(ring)
+		area += xs[i]*ring[j][1] - xs[j]*ring[i][1]
+	}
+	return area / 2
+}
+
+// crossing is a point where edges i and j of a ring cross.
+type crossing struct {
+	i, j  int
+	point s2.Point
+}
+
+// selfIntersections returns every crossing between non-adjacent edges of
+// ring. ring must already be cleaned.
+func selfIntersections(ring []geojson.Coordinate) []crossing {
+	var crossings []crossing
+	n := len(ring)
+	for i := 0; i < n; i++ {
+		a := coordinateToS2Point(ring[i])
+		b := coordinateToS2Point(ring[(i+1)%n])
+		for j := i + 2; j < n; j++ {
+			if i == 0 && j == n-1 {
+				continue
+			}
+			c := coordinateToS2Point(ring[j])
+			d := coordinateToS2Point(ring[(j+1)%n])
+			if edgesCross(a, b, c, d) {
+				crossings = append(crossings, crossing{i, j, edgeIntersection(a, b, c, d)})
+			}
+		}
+	}
+	return crossings
+}
+
+type validator struct {
+	problems []Problem
+	feature  int
+	part     int
+	ring     int
+}
+
+func (v *validator) add(vertex int, kind, severity, msg string, loc *LatLng) {
+	v.problems = append(v.problems, Problem{
+		Feature:  v.feature,
+		Part:     v.part,
+		Ring:     v.ring,
+		Vertex:   vertex,
+		Kind:     kind,
+		Severity: severity,
+		Message:  msg,
+		Location: loc,
+	})
+}
+
+func (v *validator) checkCoordinates(coords []geojson.Coordinate) {
+	for i, c := range coords {
+		if c[1] < -90 || c[1] > 90 || c[0] < -180 || c[0] > 180 {
+			v.add(i, ProblemOutOfBounds, SeverityError,
+				fmt.Sprintf("coordinate (%g, %g) is out of range", c[0], c[1]), coordinateLatLng(c))
+		}
+		if i > 0 && math.Abs(c[0]-coords[i-1][0]) > 180 {
+			v.add(i, ProblemAntimeridian, SeverityWarning,
+				"edge crosses the antimeridian", coordinateLatLng(c))
+		}
+	}
+}
+
+func (v *validator) checkRing(ring []geojson.Coordinate) {
+	v.checkCoordinates(ring)
+	if len(ring) > 0 && !sameCoordinate(ring[0], ring[len(ring)-1]) {
+		v.add(-1, ProblemUnclosedRing, SeverityWarning,
+			"ring is not closed", coordinateLatLng(ring[0]))
+	}
+	for i := 1; i < len(ring); i++ {
+		if sameCoordinate(ring[i], ring[i-1]) {
+			v.add(i, ProblemDuplicateVertex, SeverityWarning,
+				"vertex repeats the previous vertex", coordinateLatLng(ring[i]))
+		}
+	}
+	clean := cleanRing(ring)
+	if len(clean) < 3 {
+		v.add(-1, ProblemTooFewVertices, SeverityError,
+			fmt.Sprintf("ring has %d distinct vertices, need at least 3", len(clean)), nil)
+		return
+	}
+	ccw := signedArea(clean) > 0
+	if v.ring == 0 && !ccw {
+		v.add(-1, ProblemOrientation, SeverityWarning,
+			"exterior ring is clockwise", nil)
+	} else if v.ring > 0 && ccw {
+		v.add(-1, ProblemOrientation, SeverityWarning,
+			"hole is counterclockwise", nil)
+	}
+	for _, x := range selfIntersections(clean) {
+		ll := latLngFromPoint(x.point)
+		v.add(x.i, ProblemSelfIntersection, SeverityError,
+			fmt.Sprintf("edge %d crosses edge %d", x.i, x.j), &ll)
+	}
+}
+
+func (v *validator) checkPolygon(rings [][]geojson.Coordinate) {
+	for i, ring := range rings {
+		v.ring = i
+		v.checkRing(ring)
+	}
+	v.ring = -1
+}
+
+func (v *validator) checkGeometry(geom geojson.GeoJSON) {
+	v.part, v.ring = 0, -1
+	switch geom := geom.(type) {
+	case geojson.Point:
+		v.checkCoordinates([]geojson.Coordinate{geom.Coordinates})
+	case geojson.MultiPoint:
+		for i, c := range geom.Coordinates {
+			v.part = i
+			v.checkCoordinates([]geojson.Coordinate{c})
+		}
+	case geojson.LineString:
+		v.checkCoordinates(geom.Coordinates)
+	case geojson.MultiLineString:
+		for i, line := range geom.Coordinates {
+			v.part = i
+			v.checkCoordinates(line)
+		}
+	case geojson.Polygon:
+		v.checkPolygon(geom.Coordinates)
+	case geojson.MultiPolygon:
+		for i, polygon := range geom.Coordinates {
+			v.part = i
+			v.checkPolygon(polygon)
+		}
+	case geojson.GeometryCollection:
+		for _, g := range geom.Geometries {
+			v.checkGeometry(g)
+		}
+	}
+}
+
+// Validate checks every feature in js and returns the problems found,
+// in input order. An empty result means the input is clean.
+func Validate(js geojson.GeoJSON) []Problem {
+	v := new(validator)
+	for _, f := range flattenGeoJSON(js) {
+		v.feature = f.index
+		v.checkGeometry(f.geometry)
+	}
+	return v.problems
+}
+
+// HasErrors reports whether any of problems is an error rather than a
+// warning.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
@@ -1,5 +1,7 @@
 var color0 = '#FFFF00';
 var color1 = '#00FF00';
+var color2 = '#FF00FF';
+var featureColors = ['#00FF00', '#00FFFF', '#FF8800', '#FF0088', '#8888FF', '#88FF88'];
 
 L.Control.Command = L.Control.extend({
     options: {
@@ -31,11 +33,22 @@ var PageController = Backbone.Model.extend({
         return this.$s2coveringButton.is(':checked')
     },
 
+    repairGeometry: function() {
+        return this.$repairButton.is(':checked')
+    },
+
+    renderRepairs: function(repairs) {
+        _.each(repairs, _.bind(function(r) {
+            this.addInfo('repaired feature ' + r.feature + ' ring ' + r.ring + ': ' + r.message);
+        }, this));
+    },
+
     resetDisplay: function() {
         this.previousBounds = null;
         this.layerGroup.clearLayers();
         this.drawnItems.clearLayers();
         this.$infoArea.empty();
+        this.$measurements.empty();
     },
 
     addInfo: function(msg) {
@@ -93,22 +106,178 @@ var PageController = Backbone.Model.extend({
      * @param {Array.<fourSq.api.models.geo.S2Response>} cells
      * @return {Array.<L.Polygon>}
      */
-    renderCells: function(cells) {
+    renderCells: function(cells, color) {
         return _(cells).filter(function(cell) { return cell.token != "X"; })
             .map(_.bind(function(c) {
-                return this.renderCell(c);
+                // Interior cells are drawn in their own color, or more
+                // opaque when the color is per feature, so the band
+                // between the two coverings stands out.
+                if (c.covering == 'interior') {
+                    return color ? this.renderCell(c, color, null, 0.5) : this.renderCell(c, color2);
+                }
+                return this.renderCell(c, color || color1);
             }, this));
     },
 
-    renderS2Cells: function(cells) {
+    renderS2Cells: function(data) {
+        var cells = data;
+        if (data.cells) {
+            cells = data.cells;
+            this.renderRepairs(data.repairs);
+            this.renderCoveringStats(data.stats);
+        }
+        var polygons = [];
+        if (cells.length && cells[0].cells !== undefined) {
+            // One covering per feature.
+            _.each(cells, _.bind(function(f, i) {
+                var color = featureColors[i % featureColors.length];
+                polygons = polygons.concat(this.renderCells(f.cells, color));
+            }, this));
+        } else {
+            polygons = this.renderCells(cells);
+        }
         var bounds = null;
-        var polygons = this.renderCells(cells);
         _.each(polygons, function(p) {
             if (!bounds) {
                 bounds = new L.LatLngBounds([p.getBounds()]);
             }
             bounds = bounds.extend(p.getBounds());
         });
+        return bounds;
+    },
+
+    cellListMode: function() {
+        return this.$inputMode.val() == 'cells';
+    },
+
+    renderKRing: function(cell) {
+        $.ajax({
+            url: '/a/cell/neighbors',
+            type: 'GET',
+            dataType: 'json',
+            data: {
+                token: cell.token,
+                type: this.$neighborType.val(),
+                k: this.$kRing.val()
+            },
+            success: _.bind(function(rings) {
+                // One color per ring, the same way per-feature coverings
+                // are drawn.
+                this.renderS2Cells(_.map(rings, function(ring) {
+                    return {cells: ring};
+                }));
+            }, this),
+            error: _.bind(function(xhr) {
+                if (xhr.responseJSON) {
+                    this.$measurements.append($('<div>k-ring failed: ' + xhr.responseJSON.error + '</div>'));
+                }
+            }, this)
+        });
+    },
+
+    cellInfoDescription: function(info) {
+        return 'area: ' + info.area_m2.toFixed(2) + ' m&sup2;<br>' +
+            'parents: ' + _.pluck(info.parents, 'token').join(', ') + '<br>' +
+            'children: ' + _.pluck(info.children, 'token').join(', ') + '<br>' +
+            'neighbors: ' + _.pluck(info.neighbors, 'token').join(', ');
+    },
+
+    // Looks the clicked cell up with /a/cell and adds its hierarchy and
+    // neighbors to the popup.
+    inspectCell: function(cell, polygon) {
+        $.ajax({
+            url: '/a/cell',
+            type: 'GET',
+            dataType: 'json',
+            data: { token: cell.token },
+            success: _.bind(function(info) {
+                polygon.setPopupContent(this.cellDescription(info.cell) + '<p>' +
+                                        this.cellInfoDescription(info));
+            }, this)
+        });
+    },
+
+    renderCellList: function(text) {
+        $.ajax({
+            url: '/a/cells',
+            type: 'POST',
+            dataType: 'json',
+            data: { cells: text },
+            success: _.bind(function(cells) {
+                var bounds = null;
+                _.each(cells, _.bind(function(cell) {
+                    var polygon = this.renderCell(cell);
+                    polygon.on('click', _.bind(this.inspectCell, this, cell, polygon));
+                    bounds = bounds ? bounds.extend(polygon.getBounds()) : polygon.getBounds();
+                }, this));
+                this.processBounds(bounds);
+                if (this.$kRing.val()) {
+                    _.each(cells, _.bind(this.renderKRing, this));
+                }
+            }, this),
+            error: _.bind(function(xhr) {
+                var err = xhr.responseJSON;
+                if (err) {
+                    var where = err.feature !== undefined ? 'entry ' + (err.feature + 1) + ': ' : '';
+                    this.$measurements.append($('<div>' + where + err.error + '</div>'));
+                }
+            }, this)
+        });
+    },
+
+    renderCoveringStats: function(stats) {
+        _.each(stats, _.bind(function(s) {
+            var title = s.feature >= 0 ? 'feature ' + s.feature : 'covering';
+            var levels = _.map(_.keys(s.levels), function(l) {
+                return l + ': ' + s.levels[l];
+            });
+            var parts = [
+                title + ' (' + s.covering + ')',
+                'cells: ' + s.cells + ' (' + s.interior_cells + ' interior, ' +
+                    s.boundary_cells + ' boundary)',
+                'covering area: ' + (s.covering_area_m2 / 1e6).toFixed(3) + ' km&sup2;'
+            ];
+            if (s.region_area_m2 > 0) {
+                parts.push('region area: ' + (s.region_area_m2 / 1e6).toFixed(3) + ' km&sup2;');
+                parts.push('over-coverage: ' + s.over_coverage.toFixed(3));
+            }
+            parts.push('levels: ' + levels.join(', '));
+            parts.push('leaf ranges: ' + s.leaf_ranges);
+            this.$measurements.append($('<div>' + parts.join('<br>') + '</div>'));
+        }, this));
+    },
+
+    measurementDescription: function(m) {
+        var parts = [];
+        if (m.area_m2 > 0) {
+            parts.push('area: ' + m.area_km2.toFixed(3) + ' km&sup2; (' + m.area_m2.toFixed(0) + ' m&sup2;)');
+            parts.push('perimeter: ' + (m.perimeter_m / 1000).toFixed(3) + ' km');
+        }
+        if (m.length_m > 0) {
+            parts.push('length: ' + (m.length_m / 1000).toFixed(3) + ' km');
+        }
+        if (m.centroid) {
+            parts.push('centroid: ' + m.centroid.lat.toFixed(6) + ',' + m.centroid.lng.toFixed(6));
+        }
+        parts.push('loops: ' + m.loops + ', vertices: ' + m.vertices);
+        return parts.join('<br>');
+    },
+
+    renderMeasurements: function(result) {
+        this.$measurements.empty();
+        _.each(result.features, _.bind(function(m) {
+            this.$measurements.append($('<div>feature ' + m.feature + '<br>' +
+                                        this.measurementDescription(m) + '</div>'));
+        }, this));
+        if (result.features.length > 1) {
+            this.$measurements.append($('<div>total<br>' +
+                                        this.measurementDescription(result.total) + '</div>'));
+        }
+    },
+
+    renderMeasure: function(geojson) {
+        $.post('/a/measure', JSON.stringify(geojson),
+               _.bind(this.renderMeasurements, this));
     },
 
     processBounds: function(bounds) {
@@ -118,36 +287,98 @@ var PageController = Backbone.Model.extend({
         }
     },
 
+    coveringParams: function(geojson) {
+        var data = {};
+        if (this.$minLevel.val()) {
+            data['min_level'] = this.$minLevel.val();
+        }
+        if (this.$maxLevel.val()) {
+            data['max_level'] = this.$maxLevel.val();
+        }
+        if (this.$maxCells.val()) {
+            data['max_cells'] = this.$maxCells.val();
+        }
+        if (this.$levelMod.val()) {
+            data['level_mod'] = this.$levelMod.val();
+        }
+        if (this.$fixedLevel.val()) {
+            data['level'] = this.$fixedLevel.val();
+        }
+        if (this.$simplifyTolerance.val()) {
+            data['simplify_tolerance'] = this.$simplifyTolerance.val();
+        }
+        data['covering_type'] = this.$coveringType.val();
+        if (this.$perFeature.is(':checked')) {
+            data['per_feature'] = 'true';
+        }
+        if (this.repairGeometry()) {
+            data['repair'] = 'true';
+        }
+        data["geojson"] = JSON.stringify(geojson);
+        return data;
+    },
+
     renderCovering: function(geojson) {
         if (this.showS2Covering()) {
-            var data = {};
-            if (this.$minLevel.val()) {
-                data['min_level'] = this.$minLevel.val();
+            var data = this.coveringParams(geojson);
+            if (this.$coveringStats.is(':checked')) {
+                data['stats'] = 'true';
             }
-            if (this.$maxLevel.val()) {
-                data['max_level'] = this.$maxLevel.val();
-            }
-            if (this.$maxCells.val()) {
-                data['max_cells'] = this.$maxCells.val();
-            }
-            if (this.$levelMod.val()) {
-                data['level_mod'] = this.$levelMod.val();
-            }
-            data["geojson"] = JSON.stringify(geojson);
-
             $.ajax({
                 url: '/a/s2cover',
                 type: 'POST',
                 dataType: 'json',
                 data: data,
-                success: _.bind(this.renderS2Cells, this)
+                success: _.bind(this.renderS2Cells, this),
+                error: _.bind(function(xhr) {
+                    if (xhr.responseJSON) {
+                        this.$measurements.append($('<div>covering failed: ' + xhr.responseJSON.error + '</div>'));
+                    }
+                }, this)
             });
         }
     },
 
+    coveringToEditorCallback: function() {
+        var geojson = null;
+        try {
+            geojson = JSON.parse(this.editor.getValue());
+        } catch(e) {
+            return;
+        }
+        var data = this.coveringParams(geojson);
+        data['format'] = 'geojson';
+        if (this.$dissolve.is(':checked')) {
+            data['dissolve'] = 'true';
+        }
+        $.ajax({
+            url: '/a/s2cover',
+            type: 'POST',
+            dataType: 'json',
+            data: data,
+            success: _.bind(function(data) {
+                if (data.cells) {
+                    data.cells.repairs = data.repairs;
+                    data = data.cells;
+                }
+                this.operationCallback(data);
+            }, this),
+            error: _.bind(function(xhr) {
+                if (xhr.responseJSON) {
+                    this.$measurements.append($('<div>covering failed: ' + xhr.responseJSON.error + '</div>'));
+                }
+            }, this)
+        });
+    },
+
     boundsCallback: function(rebound) {
         this.setHash();
         this.resetDisplay();
+        if (this.cellListMode()) {
+            this.updateOperators();
+            this.renderCellList(this.editor.getValue());
+            return;
+        }
         var geojsonFeature = null;
         var bboxstr = this.editor.getValue();
         try {
@@ -167,11 +398,10 @@ var PageController = Backbone.Model.extend({
             }
         });
         collection.eachLayer(_.bind(this.addDrawnLayer, this));
-        if (this.drawnItems.getLayers().length >= 2) {
-            this.showSetOperators();
-        } else {
-            this.hideSetOperators();
+        if (this.drawnItems.getLayers().length > 0) {
+            this.renderMeasure(geojsonFeature);
         }
+        this.updateOperators();
         if (rebound !== false) {
             this.processBounds(this.previousBounds);
         }
@@ -186,6 +416,14 @@ var PageController = Backbone.Model.extend({
         this.drawnItems.addLayer(l);
     },
 
+    updateInputMode: function() {
+        if (this.cellListMode()) {
+            this.$cellOptions.show();
+        } else {
+            this.$cellOptions.hide();
+        }
+    },
+
     updateS2CoverMode: function() {
         if (this.showS2Covering()) {
             this.$s2options.show();
@@ -201,6 +439,8 @@ var PageController = Backbone.Model.extend({
             this.map.addControl(this.intersection);
             this.map.addControl(this.difference);
             this.map.addControl(this.symmetric_difference);
+            this.map.addControl(this.exclusive_parts);
+            this.map.addControl(this.distance);
         }
     },
 
@@ -211,15 +451,74 @@ var PageController = Backbone.Model.extend({
             this.map.removeControl(this.intersection);
             this.map.removeControl(this.difference);
             this.map.removeControl(this.symmetric_difference);
+            this.map.removeControl(this.exclusive_parts);
+            this.map.removeControl(this.distance);
         } catch (err) {}
     },
 
+    // The hull works on a single feature, such as a MultiPoint of GPS
+    // fixes, so it shows up as soon as anything is drawn.
+    showHullOperator: function() {
+        if (!this.hullVisible) {
+            this.hullVisible = true;
+            this.map.addControl(this.convex_hull);
+        }
+    },
+
+    hideHullOperator: function() {
+        try {
+            this.hullVisible = false;
+            this.map.removeControl(this.convex_hull);
+        } catch (err) {}
+    },
+
+    updateOperators: function() {
+        var n = this.drawnItems.getLayers().length;
+        if (n >= 1) {
+            this.showHullOperator();
+        } else {
+            this.hideHullOperator();
+        }
+        if (n >= 2) {
+            this.showSetOperators();
+        } else {
+            this.hideSetOperators();
+        }
+    },
+
+    distanceCallback: function(data) {
+        var a = new L.LatLng(data.closest_a.lat, data.closest_a.lng);
+        var b = new L.LatLng(data.closest_b.lat, data.closest_b.lng);
+        var line = L.geodesic([[a, b]], {
+            steps: 50,
+            color: color1,
+            weight: 2,
+            dashArray: '4, 4'
+        });
+        // The rest of the features were sent as their own collection.
+        var description = 'distance from feature 0 to feature ' + (data.b + 1) +
+            ': ' + (data.meters / 1000).toFixed(3) + ' km';
+        line.bindPopup(description);
+        this.layerGroup.addLayer(line);
+        this.$measurements.append($('<div>' + description + '</div>'));
+    },
+
+    operationUrl: function(url) {
+        if (this.repairGeometry()) {
+            url += '?repair=true';
+        }
+        return url;
+    },
+
     operationCallback: function(data) {
+        var repairs = data.repairs;
+        delete data.repairs;
         this.previousBounds = null;
         this.drawnItems.clearLayers();
-        this.hideSetOperators();
+        this.updateOperators();
         this.editor.setValue(JSON.stringify(data, null, 2));
         this.boundsCallback(false);
+        this.renderRepairs(repairs);
         this.setHash();
     },
 
@@ -234,7 +533,7 @@ var PageController = Backbone.Model.extend({
                 return;
             }
             if (obj.origin == "+delete") {
-                if (doc.getValue().length == 0) {
+                if (doc.getValue().length == 0 && !this.cellListMode()) {
                     doc.setValue(JSON.stringify({
                         "type": "FeatureCollection", "features": []
                     }, null, 2));
@@ -248,7 +547,7 @@ var PageController = Backbone.Model.extend({
             text: '&#x22C3;',
             title: 'Set Union',
             click: _.bind(function() {
-                $.post("/a/union", JSON.stringify(this.drawnItems.toGeoJSON()),
+                $.post(this.operationUrl("/a/union"), JSON.stringify(this.drawnItems.toGeoJSON()),
                        _.bind(this.operationCallback, this));
             }, this)
         });
@@ -257,7 +556,7 @@ var PageController = Backbone.Model.extend({
             text: '&#x22C2;',
             title: 'Set Intersection',
             click: _.bind(function() {
-                $.post("/a/intersection", JSON.stringify(this.drawnItems.toGeoJSON()),
+                $.post(this.operationUrl("/a/intersection"), JSON.stringify(this.drawnItems.toGeoJSON()),
                        _.bind(this.operationCallback, this));
             }, this)
         });
@@ -266,7 +565,7 @@ var PageController = Backbone.Model.extend({
             text: '&#x2212;',
             title: 'Set Difference',
             click: _.bind(function() {
-                $.post("/a/difference", JSON.stringify(this.drawnItems.toGeoJSON()),
+                $.post(this.operationUrl("/a/difference"), JSON.stringify(this.drawnItems.toGeoJSON()),
                        _.bind(this.operationCallback, this));
             }, this)
         });
@@ -275,7 +574,39 @@ var PageController = Backbone.Model.extend({
             text: '&#x2295',
             title: 'Symmetric Difference',
             click: _.bind(function() {
-                $.post("/a/symmetric_difference", JSON.stringify(this.drawnItems.toGeoJSON()),
+                $.post(this.operationUrl("/a/symmetric_difference"), JSON.stringify(this.drawnItems.toGeoJSON()),
+                       _.bind(this.operationCallback, this));
+            }, this)
+        });
+
+        this.exclusive_parts = L.control.command({
+            text: '&#x2296;',
+            title: 'Exclusive Parts',
+            click: _.bind(function() {
+                $.post(this.operationUrl("/a/exclusive_parts"), JSON.stringify(this.drawnItems.toGeoJSON()),
+                       _.bind(this.operationCallback, this));
+            }, this)
+        });
+
+        this.distance = L.control.command({
+            text: '&#x2194;',
+            title: 'Distance from the first feature to the rest',
+            click: _.bind(function() {
+                var features = this.drawnItems.toGeoJSON().features;
+                var body = {
+                    a: features[0],
+                    b: {type: 'FeatureCollection', features: features.slice(1)}
+                };
+                $.post("/a/distance", JSON.stringify(body),
+                       _.bind(this.distanceCallback, this));
+            }, this)
+        });
+
+        this.convex_hull = L.control.command({
+            text: '&#x25C7;',
+            title: 'Convex Hull',
+            click: _.bind(function() {
+                $.post(this.operationUrl("/a/convex_hull"), JSON.stringify(this.drawnItems.toGeoJSON()),
                        _.bind(this.operationCallback, this));
             }, this)
         });
@@ -323,7 +654,7 @@ var PageController = Backbone.Model.extend({
                         weight: 2,
                         color: color0
                     },
-                    showArea: true
+                    showArea: false
                 },
             },
             edit: {
@@ -356,6 +687,7 @@ var PageController = Backbone.Model.extend({
 
         this.$el = $(document);
         this.$infoArea = this.$el.find('.info');
+        this.$measurements = this.$el.find('.measurements');
 
         this.$boundsButton = this.$el.find('.boundsButton');
         this.$boundsButton.click(_.bind(this.boundsCallback, this));
@@ -368,10 +700,48 @@ var PageController = Backbone.Model.extend({
             this.boundsCallback();
         }, this));
 
+        this.$repairButton = this.$el.find('.repair');
+        this.$repairButton.change(_.bind(function() {
+            this.setHash();
+            this.boundsCallback();
+        }, this));
+
         this.$maxCells = this.$el.find('.max_cells');
         this.$maxLevel = this.$el.find('.max_level');
         this.$minLevel = this.$el.find('.min_level');
         this.$levelMod = this.$el.find('.level_mod');
+        this.$fixedLevel = this.$el.find('.fixed_level');
+        this.$simplifyTolerance = this.$el.find('.simplify_tolerance');
+        this.$dissolve = this.$el.find('.dissolve');
+        this.$coveringStats = this.$el.find('.covering_stats');
+        this.$coveringStats.change(_.bind(function() {
+            this.setHash();
+            this.boundsCallback();
+        }, this));
+        this.$coveringToEditorButton = this.$el.find('.coveringToEditorButton');
+        this.$coveringToEditorButton.click(_.bind(this.coveringToEditorCallback, this));
+        this.$perFeature = this.$el.find('.per_feature');
+        this.$perFeature.change(_.bind(function() {
+            this.setHash();
+            this.boundsCallback();
+        }, this));
+        this.$coveringType = this.$el.find('.covering_type');
+        this.$coveringType.change(_.bind(function() {
+            this.setHash();
+            this.boundsCallback();
+        }, this));
+
+        this.$inputMode = this.$el.find('.input_mode');
+        this.$inputMode.change(_.bind(function() {
+            this.updateInputMode();
+            this.setHash();
+            this.boundsCallback();
+        }, this));
+        this.$cellOptions = this.$el.find('.cellOptions');
+        this.$kRing = this.$el.find('.k_ring');
+        this.$kRing.change(_.bind(this.boundsCallback, this));
+        this.$neighborType = this.$el.find('.neighbor_type');
+        this.$neighborType.change(_.bind(this.boundsCallback, this));
 
         // https://github.com/blackmad/s2map
     },
@@ -379,9 +749,7 @@ var PageController = Backbone.Model.extend({
     drawDeletedCallback: function(e) {
         this.editor.setValue(JSON.stringify(this.drawnItems.toGeoJSON(), null, 2));
         this.setHash();
-        if (this.drawnItems.getLayers().length < 2) {
-            this.hideSetOperators();
-        }
+        this.updateOperators();
         var bounds = null;
         this.drawnItems.eachLayer(function(l) {
             if (bounds === null) { bounds = l.getBounds(); return; }
@@ -393,6 +761,7 @@ var PageController = Backbone.Model.extend({
 
     drawEditedCallback: function(e) {
         this.editor.setValue(JSON.stringify(this.drawnItems.toGeoJSON(), null, 2));
+        this.renderMeasure(this.drawnItems.toGeoJSON());
         this.setHash();
     },
 
@@ -411,10 +780,9 @@ var PageController = Backbone.Model.extend({
             this.addDrawnLayer(layer);
             this.processBounds(this.previousBounds);
             this.editor.setValue(JSON.stringify(this.drawnItems.toGeoJSON(), null, 2));
+            this.renderMeasure(this.drawnItems.toGeoJSON());
             this.setHash();
-            if (this.drawnItems.getLayers().length >= 2) {
-                this.showSetOperators();
-            }
+            this.updateOperators();
         }
     },
 
@@ -439,6 +807,22 @@ var PageController = Backbone.Model.extend({
             addParam("s2_max_level", this.$maxLevel.val());
             addParam("s2_max_cells", this.$maxCells.val());
             addParam("s2_level_mod", this.$levelMod.val());
+            addParam("s2_covering_type", this.$coveringType.val());
+            if (this.$fixedLevel.val()) {
+                addParam("s2_level", this.$fixedLevel.val());
+            }
+            if (this.$perFeature.is(':checked')) {
+                addParam("s2_per_feature", 'true');
+            }
+            if (this.$coveringStats.is(':checked')) {
+                addParam("s2_stats", 'true');
+            }
+        }
+        if (this.repairGeometry()) {
+            addParam("repair", 'true');
+        }
+        if (this.cellListMode()) {
+            addParam("input", 'cells');
         }
         window.location.hash = h;
     },
@@ -464,11 +848,30 @@ var PageController = Backbone.Model.extend({
         if (params.s2 == 'true') {
             this.$s2coveringButton.attr('checked', 'checked');
         }
+        if (params.repair == 'true') {
+            this.$repairButton.attr('checked', 'checked');
+        }
+        if (params.input == 'cells') {
+            this.$inputMode.val('cells');
+        }
+        this.updateInputMode();
 
         this.updateS2CoverMode();
         this.$maxCells.val(params.max_cells);
         this.$minLevel.val(params.min_level);
         this.$maxLevel.val(params.max_level);
         this.$levelMod.val(params.level_mod);
+        if (params.s2_per_feature == 'true') {
+            this.$perFeature.attr('checked', 'checked');
+        }
+        if (params.s2_stats == 'true') {
+            this.$coveringStats.attr('checked', 'checked');
+        }
+        if (params.s2_level) {
+            this.$fixedLevel.val(params.s2_level);
+        }
+        if (params.s2_covering_type) {
+            this.$coveringType.val(params.s2_covering_type);
+        }
     },
 });